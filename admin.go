@@ -0,0 +1,246 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/j-forster/Waziup-API/logging"
+	"github.com/j-forster/Waziup-API/mqtt"
+	"github.com/j-forster/Waziup-API/tools"
+	routing "github.com/julienschmidt/httprouter"
+)
+
+var logAPI = logging.For("api")
+
+// requireAdmin checks the HTTP Basic credentials of the request (or the
+// user of the MQTT connection) and writes a 401 response if they do not
+// belong to an admin user.
+func requireAdmin(resp http.ResponseWriter, req *http.Request) bool {
+
+	if user := currentConfig().User(requestUser(req)); user != nil && user.Admin {
+		return true
+	}
+	resp.Header().Set("WWW-Authenticate", `Basic realm="WaziHub Admin"`)
+	http.Error(resp, "Unauthorized: Admin credentials required.", http.StatusUnauthorized)
+	return false
+}
+
+// requestUser returns the user of the MQTT connection of the request (see
+// connUser) or of its HTTP Basic credentials, "" if it has none.
+func requestUser(req *http.Request) string {
+
+	if name, ok := mqttUser(req); ok {
+		return name
+	}
+	if name, password, ok := req.BasicAuth(); ok {
+		if user, _ := currentConfig().Authenticate(name, password); user != nil {
+			return user.Name
+		}
+	}
+	return ""
+}
+
+// adminOnly wraps a route that changes devices or gateways: only admins may
+// use it, unless there are no users in the configuration (an open server).
+func adminOnly(handle routing.Handle) routing.Handle {
+
+	return func(resp http.ResponseWriter, req *http.Request, params routing.Params) {
+		if len(currentConfig().Users) == 0 || requireAdmin(resp, req) {
+			handle(resp, req, params)
+		}
+	}
+}
+
+////////////////////
+
+func AdminReload(resp http.ResponseWriter, req *http.Request, params routing.Params) {
+
+	if !requireAdmin(resp, req) {
+		return
+	}
+
+	if err := reload(); err != nil {
+		http.Error(resp, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logAPI.Info("configuration reloaded", "remote", req.RemoteAddr)
+	resp.Write([]byte("Reloaded."))
+}
+
+////////////////////
+
+// bans are client IDs that may not connect (until the server restarts).
+var bans = make(map[string]time.Time)
+var bansMutex sync.Mutex
+
+func banned(clientID string) bool {
+
+	bansMutex.Lock()
+	_, ok := bans[clientID]
+	bansMutex.Unlock()
+	return ok
+}
+
+// kick disconnects all connections with the client ID.
+func kick(clientID string) bool {
+
+	found := false
+	for _, conn := range mqttServer.Connections() {
+		if conn.ClientID == clientID {
+			conn.Disconnect(mqtt.ADMINISTRATIVE_ACTION)
+			found = true
+		}
+	}
+	return found
+}
+
+////////////////////
+
+type clientInfo struct {
+	ClientID       string    `json:"client_id"`
+	User           string    `json:"user,omitempty"`
+	Listener       string    `json:"listener,omitempty"`
+	RemoteAddr     string    `json:"remote_addr,omitempty"`
+	ConnectedSince time.Time `json:"connected_since"`
+	Subscriptions  []string  `json:"subscriptions"`
+	Inflight       int       `json:"inflight"`
+}
+
+func AdminGetClients(resp http.ResponseWriter, req *http.Request, params routing.Params) {
+
+	if !requireAdmin(resp, req) {
+		return
+	}
+
+	clients := []*clientInfo{}
+	for _, conn := range mqttServer.Connections() {
+		since := conn.ConnectedSince()
+		if since.IsZero() {
+			// not (yet) connected
+			continue
+		}
+		clients = append(clients, &clientInfo{
+			ClientID:       conn.ClientID,
+			User:           connUser(conn),
+			Listener:       conn.Listener,
+			RemoteAddr:     conn.RemoteAddr,
+			ConnectedSince: since,
+			Subscriptions:  conn.Subscriptions(),
+			Inflight:       conn.Inflight(),
+		})
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ClientID < clients[j].ClientID
+	})
+	tools.WriteJSON(resp, clients)
+}
+
+func AdminDeleteClient(resp http.ResponseWriter, req *http.Request, params routing.Params) {
+
+	if !requireAdmin(resp, req) {
+		return
+	}
+
+	clientID := params.ByName("client_id")
+	if !kick(clientID) {
+		http.Error(resp, "Not Found: Client is not connected.", http.StatusNotFound)
+		return
+	}
+	logAPI.Info("client disconnected by admin", "client", clientID, "remote", req.RemoteAddr)
+	resp.Write([]byte("Disconnected."))
+}
+
+////////////////////
+
+type banInfo struct {
+	ClientID string    `json:"client_id"`
+	Since    time.Time `json:"since"`
+}
+
+func AdminGetBans(resp http.ResponseWriter, req *http.Request, params routing.Params) {
+
+	if !requireAdmin(resp, req) {
+		return
+	}
+
+	list := []*banInfo{}
+	bansMutex.Lock()
+	for clientID, since := range bans {
+		list = append(list, &banInfo{clientID, since})
+	}
+	bansMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ClientID < list[j].ClientID
+	})
+	tools.WriteJSON(resp, list)
+}
+
+func AdminPutBan(resp http.ResponseWriter, req *http.Request, params routing.Params) {
+
+	if !requireAdmin(resp, req) {
+		return
+	}
+
+	clientID := params.ByName("client_id")
+	bansMutex.Lock()
+	if _, ok := bans[clientID]; !ok {
+		bans[clientID] = time.Now()
+	}
+	bansMutex.Unlock()
+	kick(clientID)
+	logAPI.Info("client banned", "client", clientID, "remote", req.RemoteAddr)
+	resp.Write([]byte("Banned."))
+}
+
+func AdminDeleteBan(resp http.ResponseWriter, req *http.Request, params routing.Params) {
+
+	if !requireAdmin(resp, req) {
+		return
+	}
+
+	clientID := params.ByName("client_id")
+	bansMutex.Lock()
+	_, ok := bans[clientID]
+	delete(bans, clientID)
+	bansMutex.Unlock()
+	if !ok {
+		http.Error(resp, "Not Found: Client is not banned.", http.StatusNotFound)
+		return
+	}
+	logAPI.Info("client unbanned", "client", clientID, "remote", req.RemoteAddr)
+	resp.Write([]byte("Unbanned."))
+}
+
+////////////////////
+
+func AdminGetTopics(resp http.ResponseWriter, req *http.Request, params routing.Params) {
+
+	if !requireAdmin(resp, req) {
+		return
+	}
+
+	topics := mqttServer.Topics()
+	if topics == nil {
+		http.Error(resp, "Service Unavailable: MQTT server closed.", http.StatusServiceUnavailable)
+		return
+	}
+	tools.WriteJSON(resp, topics)
+}
+
+func AdminDeleteRetained(resp http.ResponseWriter, req *http.Request, params routing.Params) {
+
+	if !requireAdmin(resp, req) {
+		return
+	}
+
+	topic := strings.TrimPrefix(params.ByName("topic"), "/")
+	if !mqttServer.DeleteRetained(topic) {
+		http.Error(resp, "Not Found: No retained message.", http.StatusNotFound)
+		return
+	}
+	logAPI.Info("retained message deleted", "topic", topic, "remote", req.RemoteAddr)
+	resp.Write([]byte("Deleted."))
+}
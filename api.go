@@ -1,7 +1,12 @@
 package main
 
 import (
+	"net/http"
+	"strings"
+
 	"github.com/j-forster/Waziup-API/api"
+	"github.com/j-forster/Waziup-API/metrics"
+	"github.com/j-forster/Waziup-API/mqtt"
 	routing "github.com/julienschmidt/httprouter"
 )
 
@@ -9,6 +14,103 @@ var router = routing.New()
 
 func init() {
 
+	api.Publish = func(msg *mqtt.Message) error {
+		return mqttServer.Publish(nil, msg)
+	}
+	api.RequestUser = requestUser
+
 	router.POST("/auth/token", api.GetToken)
 	router.GET("/auth/permissions", api.GetPermissions)
+
+	router.GET("/devices", api.GetDevices)
+	router.POST("/devices", adminOnly(api.CreateDevice))
+	router.GET("/devices/:device_id", api.GetDevice)
+	router.GET("/devices/:device_id/actuators", api.GetActuators)
+	router.POST("/devices/:device_id/actuators", adminOnly(api.CreateActuator))
+	router.GET("/devices/:device_id/actuators/:actuator_id", api.GetActuator)
+	router.DELETE("/devices/:device_id/actuators/:actuator_id", adminOnly(api.DeleteActuator))
+	router.GET("/devices/:device_id/actuators/:actuator_id/value", api.GetActuatorValue)
+	router.PUT("/devices/:device_id/actuators/:actuator_id/value", api.SetActuatorValue)
+	router.GET("/devices/:device_id/commands", api.GetCommands)
+	router.GET("/devices/:device_id/commands/:command_id", api.GetCommand)
+	router.POST("/devices/:device_id/acks", api.PostCommandAck)
+	router.GET("/devices/:device_id/shadow", api.GetShadow)
+	router.PATCH("/devices/:device_id/shadow", api.PatchShadow)
+	router.POST("/devices/:device_id/shadow/reported", api.PostShadowReported)
+
+	router.GET("/gateways", api.GetGateways)
+	router.POST("/gateways", adminOnly(api.CreateGateway))
+	router.GET("/gateways/:gateway_id", api.GetGateway)
+	router.PUT("/gateways/:gateway_id", adminOnly(api.UpdateGateway))
+	router.DELETE("/gateways/:gateway_id", adminOnly(api.DeleteGateway))
+	router.GET("/gateways/:gateway_id/devices", api.GetGatewayDevices)
+	router.POST("/gateways/:gateway_id/heartbeat", api.PostGatewayHeartbeat)
+
+	router.POST("/admin/reload", AdminReload)
+	router.GET("/admin/clients", AdminGetClients)
+	router.DELETE("/admin/clients/:client_id", AdminDeleteClient)
+	router.GET("/admin/bans", AdminGetBans)
+	router.PUT("/admin/bans/:client_id", AdminPutBan)
+	router.DELETE("/admin/bans/:client_id", AdminDeleteBan)
+	router.GET("/admin/topics", AdminGetTopics)
+	router.DELETE("/admin/retained/*topic", AdminDeleteRetained)
+
+	router.GET("/stream", GetStream)
+	router.POST("/mqtt/publish/*topic", PostPublish)
+
+	router.Handler(http.MethodGet, "/metrics", metrics.Handler())
+	router.GET("/health/live", GetHealthLive)
+	router.GET("/health/ready", GetHealthReady)
+}
+
+// publishRoute tells if a POST route handles the MQTT message of the request.
+func publishRoute(req *http.Request) bool {
+
+	handle, _, _ := router.Lookup(http.MethodPost, req.URL.Path)
+	return handle != nil
+}
+
+// serveRoute routes the request. MQTT messages (method PUBLISH) are handled
+// by the POST route of the topic, see mqttapi.go.
+func serveRoute(resp http.ResponseWriter, req *http.Request) {
+
+	if req.Method != "PUBLISH" {
+		router.ServeHTTP(resp, req)
+		return
+	}
+	handle, params, _ := router.Lookup(http.MethodPost, req.URL.Path)
+	if handle == nil {
+		http.Error(resp, "Not Found: No route for the topic.", http.StatusNotFound)
+		return
+	}
+	handle(resp, req, params)
+}
+
+// routeOf returns the route pattern that matches the request,
+// e.g. "/devices/:device_id" (used as metrics label).
+func routeOf(req *http.Request) string {
+
+	method := req.Method
+	if method == "PUBLISH" {
+		method = http.MethodPost
+	}
+	handle, params, _ := router.Lookup(method, req.URL.Path)
+	if handle == nil {
+		return "unmatched"
+	}
+	segments := strings.Split(req.URL.Path, "/")
+	for _, param := range params {
+		for i, segment := range segments {
+			if segment == param.Value {
+				segments[i] = ":" + param.Key
+				break
+			}
+		}
+		if strings.HasPrefix(param.Value, "/") {
+			// catch-all parameter
+			path := strings.Join(segments, "/")
+			return strings.TrimSuffix(path, param.Value) + "/*" + param.Key
+		}
+	}
+	return strings.Join(segments, "/")
 }
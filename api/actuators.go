@@ -0,0 +1,419 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/j-forster/Waziup-API/mqtt"
+	"github.com/j-forster/Waziup-API/tools"
+
+	router "github.com/julienschmidt/httprouter"
+)
+
+// Actuator is a part of a device that can be controlled, like a pump or a
+// valve. Setting its value sends a command to the device.
+type Actuator struct {
+	Id           string `json:"id"`
+	Name         string `json:"name"`
+	ActuatorKind string `json:"actuator_kind"`
+	// "boolean", "number", "string" or "object", any value if empty
+	ValueType string      `json:"value_type"`
+	Value     interface{} `json:"value"`
+}
+
+// Command is a value sent to an actuator. It is published at
+// "devices/<device_id>/commands" with QoS 1:
+//
+//	{"id": "<command_id>", "actuator_id": "<actuator_id>", "value": ...}
+//
+// and acknowledged by the device at "devices/<device_id>/acks"
+// (or by POST /devices/:device_id/acks):
+//
+//	{"id": "<command_id>", "status": "acknowledged" or "failed", "error": "..."}
+//
+// Commands that are not acknowledged in time expire. They are not expired by
+// a timer: a pending command is reported "expired" by the first GET after its
+// ttl, nothing is published or stored at that time.
+type Command struct {
+	Id         string      `json:"id"`
+	DeviceId   string      `json:"device_id"`
+	ActuatorId string      `json:"actuator_id"`
+	Value      interface{} `json:"value"`
+	// "pending", "acknowledged", "failed" or "expired"
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	Updated time.Time `json:"updated"`
+}
+
+const (
+	// time for the acknowledgement, unless the request has "?ttl=<seconds>"
+	defaultCommandTTL = time.Minute
+	maxCommandTTL     = 24 * time.Hour
+	// commands kept per device
+	maxDeviceCommands = 100
+)
+
+// Publish publishes a message at the MQTT server, it is set by the server.
+// It returns an error if the message was refused.
+var Publish = func(msg *mqtt.Message) error { return nil }
+
+var commands = make(map[string]*Command)
+var deviceCommands = make(map[string][]*Command) // by device id, oldest first
+var commandsMutex sync.Mutex
+
+func validValue(valueType string, value interface{}) bool {
+
+	switch valueType {
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	}
+	return true
+}
+
+// findActuator returns the device and its actuator,
+// it writes a 404 response if one is missing. The devicesMutex must be held.
+func findActuator(resp http.ResponseWriter, params router.Params) (*Device, *Actuator) {
+
+	device := devices[params.ByName("device_id")]
+	if device == nil {
+		http.Error(resp, "Not Found: Device not found.", http.StatusNotFound)
+		return nil, nil
+	}
+	id := params.ByName("actuator_id")
+	for _, actuator := range device.Actuators {
+		if actuator.Id == id {
+			return device, actuator
+		}
+	}
+	http.Error(resp, "Not Found: Actuator not found.", http.StatusNotFound)
+	return device, nil
+}
+
+////////////////////
+
+func GetActuators(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	device := devices[params.ByName("device_id")]
+	if device == nil {
+		http.Error(resp, "Not Found: Device not found.", http.StatusNotFound)
+		return
+	}
+	actuators := device.Actuators
+	if actuators == nil {
+		actuators = []*Actuator{}
+	}
+	tools.WriteJSON(resp, actuators)
+}
+
+func CreateActuator(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	data, err := tools.ReadAll(req.Body)
+	if err != nil {
+		http.Error(resp, "Request Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	actuator := &Actuator{}
+	if err := json.Unmarshal(data, actuator); err != nil {
+		http.Error(resp, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch actuator.ValueType {
+	case "", "boolean", "number", "string", "object":
+	default:
+		http.Error(resp, "Bad Request: value_type must be boolean, number, string or object.", http.StatusBadRequest)
+		return
+	}
+	if actuator.Value != nil && !validValue(actuator.ValueType, actuator.Value) {
+		http.Error(resp, "Bad Request: Value is not of the value_type.", http.StatusBadRequest)
+		return
+	}
+	if actuator.Id == "" {
+		actuator.Id = uuid.New().String()
+	}
+	if strings.ContainsAny(actuator.Id, "/+#") {
+		http.Error(resp, "Bad Request: Invalid actuator id.", http.StatusBadRequest)
+		return
+	}
+
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	device := devices[params.ByName("device_id")]
+	if device == nil {
+		http.Error(resp, "Not Found: Device not found.", http.StatusNotFound)
+		return
+	}
+	for _, a := range device.Actuators {
+		if a.Id == actuator.Id {
+			http.Error(resp, "Conflict: Actuator exists.", http.StatusConflict)
+			return
+		}
+	}
+	device.Actuators = append(device.Actuators, actuator)
+
+	resp.Header().Set("Content-Type", "text/plain")
+	resp.Write([]byte(actuator.Id))
+}
+
+func GetActuator(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	if _, actuator := findActuator(resp, params); actuator != nil {
+		tools.WriteJSON(resp, actuator)
+	}
+}
+
+func DeleteActuator(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	device, actuator := findActuator(resp, params)
+	if actuator == nil {
+		return
+	}
+	for i, a := range device.Actuators {
+		if a == actuator {
+			device.Actuators = append(device.Actuators[:i], device.Actuators[i+1:]...)
+			break
+		}
+	}
+	resp.Write([]byte("Deleted."))
+}
+
+func GetActuatorValue(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	if _, actuator := findActuator(resp, params); actuator != nil {
+		tools.WriteJSON(resp, actuator.Value)
+	}
+}
+
+// SetActuatorValue sends the value to the device as a command and keeps it
+// once it is sent, the response is the command (202 Accepted).
+func SetActuatorValue(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	data, err := tools.ReadAll(req.Body)
+	if err != nil {
+		http.Error(resp, "Request Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		http.Error(resp, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := defaultCommandTTL
+	if s := req.URL.Query().Get("ttl"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 || seconds > int(maxCommandTTL/time.Second) {
+			http.Error(resp, "Bad Request: ttl must be 1 to 86400 seconds.", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	devicesMutex.Lock()
+	device, actuator := findActuator(resp, params)
+	if actuator == nil {
+		devicesMutex.Unlock()
+		return
+	}
+	if !validValue(actuator.ValueType, value) {
+		devicesMutex.Unlock()
+		http.Error(resp, "Bad Request: Value is not of the value_type.", http.StatusBadRequest)
+		return
+	}
+	devicesMutex.Unlock()
+
+	now := time.Now().UTC()
+	cmd := &Command{
+		Id:         uuid.New().String(),
+		DeviceId:   device.Id,
+		ActuatorId: actuator.Id,
+		Value:      value,
+		Status:     "pending",
+		Created:    now,
+		Expires:    now.Add(ttl),
+		Updated:    now,
+	}
+	addCommand(cmd)
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"id":          cmd.Id,
+		"actuator_id": cmd.ActuatorId,
+		"value":       cmd.Value,
+	})
+	msg := mqtt.NewMessage("devices/"+device.Id+"/commands", payload, 1, false)
+	msg.ContentType = "application/json"
+	if err := Publish(msg.WithContext(req.Context())); err != nil {
+		updateCommand(cmd.DeviceId, cmd.Id, "failed", err.Error())
+		http.Error(resp, "Service Unavailable: Command not sent: "+err.Error()+".", http.StatusServiceUnavailable)
+		return
+	}
+	// the value of a command that was not sent is not the value of the actuator
+	devicesMutex.Lock()
+	actuator.Value = value
+	devicesMutex.Unlock()
+
+	commandsMutex.Lock()
+	data, _ = json.Marshal(cmd)
+	commandsMutex.Unlock()
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusAccepted)
+	resp.Write(data)
+}
+
+////////////////////
+
+func addCommand(cmd *Command) {
+
+	commandsMutex.Lock()
+	defer commandsMutex.Unlock()
+
+	commands[cmd.Id] = cmd
+	list := append(deviceCommands[cmd.DeviceId], cmd)
+	if len(list) > maxDeviceCommands {
+		delete(commands, list[0].Id)
+		list[0] = nil
+		list = list[1:]
+	}
+	deviceCommands[cmd.DeviceId] = list
+}
+
+// expire marks the command expired if it is pending after its ttl.
+// Commands expire when they are read, not by a timer.
+// The commandsMutex must be held.
+func expire(cmd *Command, now time.Time) {
+
+	if cmd.Status == "pending" && now.After(cmd.Expires) {
+		cmd.Status = "expired"
+		cmd.Updated = cmd.Expires
+	}
+}
+
+// updateCommand sets the status of a pending command,
+// it returns the status the command had.
+func updateCommand(deviceId, id, status, errorText string) (string, bool) {
+
+	commandsMutex.Lock()
+	defer commandsMutex.Unlock()
+
+	cmd := commands[id]
+	if cmd == nil || cmd.DeviceId != deviceId {
+		return "", false
+	}
+	expire(cmd, time.Now().UTC())
+	old := cmd.Status
+	if old == "pending" {
+		cmd.Status = status
+		cmd.Error = errorText
+		cmd.Updated = time.Now().UTC()
+	}
+	return old, true
+}
+
+func GetCommands(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	commandsMutex.Lock()
+	list := append([]*Command{}, deviceCommands[params.ByName("device_id")]...)
+	now := time.Now().UTC()
+	for _, cmd := range list {
+		expire(cmd, now)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Created.After(list[j].Created)
+	})
+	data, err := json.Marshal(list)
+	commandsMutex.Unlock()
+
+	if err != nil {
+		http.Error(resp, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(data)
+}
+
+func GetCommand(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	commandsMutex.Lock()
+	cmd := commands[params.ByName("command_id")]
+	var data []byte
+	if cmd != nil && cmd.DeviceId == params.ByName("device_id") {
+		expire(cmd, time.Now().UTC())
+		data, _ = json.Marshal(cmd)
+	}
+	commandsMutex.Unlock()
+
+	if data == nil {
+		http.Error(resp, "Not Found: Command not found.", http.StatusNotFound)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(data)
+}
+
+// PostCommandAck is the acknowledgement of a command by the device,
+// e.g. by MQTT at "devices/<device_id>/acks".
+func PostCommandAck(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	data, err := tools.ReadAll(req.Body)
+	if err != nil {
+		http.Error(resp, "Request Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ack struct {
+		Id     string `json:"id"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &ack); err != nil {
+		http.Error(resp, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch ack.Status {
+	case "":
+		ack.Status = "acknowledged"
+	case "acknowledged", "failed":
+	default:
+		http.Error(resp, "Bad Request: status must be acknowledged or failed.", http.StatusBadRequest)
+		return
+	}
+
+	old, ok := updateCommand(params.ByName("device_id"), ack.Id, ack.Status, ack.Error)
+	if !ok {
+		http.Error(resp, "Not Found: Command not found.", http.StatusNotFound)
+		return
+	}
+	if old != "pending" {
+		http.Error(resp, "Conflict: Command is "+old+".", http.StatusConflict)
+		return
+	}
+	resp.Write([]byte("OK."))
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/j-forster/Waziup-API/tools"
@@ -12,18 +14,23 @@ import (
 )
 
 type Device struct {
-	Id        string    `json:"id"`
-	Name      string    `json:"name"`
-	GatewayId string    `json:"gateway_id"`
-	Sensors   []*Sensor `json:"sensors"`
+	Id        string      `json:"id"`
+	Name      string      `json:"name"`
+	GatewayId string      `json:"gateway_id"`
+	Sensors   []*Sensor   `json:"sensors"`
+	Actuators []*Actuator `json:"actuators"`
 }
 
-var devices map[string]*Device
+var devices = make(map[string]*Device)
+var devicesMutex sync.Mutex
 
 ////////////////////
 
 func GetDevices(resp http.ResponseWriter, req *http.Request, params router.Params) {
 
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
 	buf := bytes.Buffer{}
 	buf.Write([]byte{'['})
 	for _, device := range devices {
@@ -33,8 +40,10 @@ func GetDevices(resp http.ResponseWriter, req *http.Request, params router.Param
 			http.Error(resp, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if buf.Len() != 1 {
+			buf.Write([]byte{','})
+		}
 		buf.Write(data)
-		buf.Write([]byte{','})
 	}
 	buf.Write([]byte{']'})
 	resp.Write(buf.Bytes())
@@ -58,7 +67,14 @@ func CreateDevice(resp http.ResponseWriter, req *http.Request, params router.Par
 		// NOT-CONFORM: Create a unique id if no id was given.
 		device.Id = uuid.New().String()
 	}
+	// the id is a topic level, e.g. of the shadow
+	if strings.ContainsAny(device.Id, "/+#") {
+		http.Error(resp, "Bad Request: Invalid device id.", http.StatusBadRequest)
+		return
+	}
+	devicesMutex.Lock()
 	devices[device.Id] = device
+	devicesMutex.Unlock()
 
 	// NOT-CONFORM: Return id on success.
 	resp.Header().Set("Content-Type", "text/plain")
@@ -68,6 +84,9 @@ func CreateDevice(resp http.ResponseWriter, req *http.Request, params router.Par
 func GetDevice(resp http.ResponseWriter, req *http.Request, params router.Params) {
 	id := params.ByName("device_id")
 
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
 	device := devices[id]
 	if device == nil {
 		http.Error(resp, "Not Found: Device not found.", http.StatusNotFound)
@@ -0,0 +1,302 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/j-forster/Waziup-API/tools"
+
+	router "github.com/julienschmidt/httprouter"
+)
+
+// Gateway connects devices (e.g. radio nodes) to the server. The MQTT client
+// of the gateway uses the gateway id as client ID and authenticates as the
+// owner (a user, or "device:<name>" with a client certificate): the devices
+// it publishes for (at "devices/<device_id>/...") are associated with the
+// gateway, unless they belong to another one, and its connection tells if the
+// gateway is connected. Gateways without owner are never connected.
+type Gateway struct {
+	Id              string    `json:"id"`
+	Name            string    `json:"name"`
+	Owner           string    `json:"owner"`
+	Location        *Location `json:"location,omitempty"`
+	SoftwareVersion string    `json:"software_version"`
+	// maintained by the server
+	Connected bool       `json:"connected"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+}
+
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+var gateways = make(map[string]*Gateway)
+var gatewaysMutex sync.Mutex
+
+// ConnectedGateways returns the ids of the connected gateways,
+// it is set by the server.
+var ConnectedGateways = func() map[string]bool { return nil }
+
+// RequestUser returns the user (or device principal) of the request,
+// "" if it has none. It is set by the server.
+var RequestUser = func(req *http.Request) string { return "" }
+
+// owns tells if the principal is the owner of the gateway,
+// the mutex must be held.
+func (gateway *Gateway) owns(principal string) bool {
+
+	return gateway.Owner != "" && gateway.Owner == principal
+}
+
+// GatewaySeen updates the last seen time of the gateway. It returns false if
+// there is no gateway with the id or the principal is not its owner.
+func GatewaySeen(id, principal string) bool {
+
+	gatewaysMutex.Lock()
+	defer gatewaysMutex.Unlock()
+
+	gateway := gateways[id]
+	if gateway == nil || !gateway.owns(principal) {
+		return false
+	}
+	now := time.Now().UTC()
+	gateway.LastSeen = &now
+	return true
+}
+
+// AssociateDevice sets the gateway of the device if it has none. It returns
+// false if there is no such device or it belongs to another gateway, a
+// gateway can not take over the devices of others.
+func AssociateDevice(gatewayId, deviceId string) bool {
+
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	device := devices[deviceId]
+	if device == nil || (device.GatewayId != "" && device.GatewayId != gatewayId) {
+		return false
+	}
+	device.GatewayId = gatewayId
+	return true
+}
+
+// gatewayCopy returns a copy of the gateway with the connected status,
+// the mutex must be held.
+func gatewayCopy(gateway *Gateway, connected map[string]bool) *Gateway {
+
+	g := *gateway
+	g.Connected = connected[g.Id]
+	return &g
+}
+
+// readGateway reads the gateway of the request body,
+// the fields maintained by the server are ignored.
+func readGateway(resp http.ResponseWriter, req *http.Request) *Gateway {
+
+	data, err := tools.ReadAll(req.Body)
+	if err != nil {
+		http.Error(resp, "Request Error: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	gateway := &Gateway{}
+	if err := json.Unmarshal(data, gateway); err != nil {
+		http.Error(resp, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if strings.ContainsAny(gateway.Id, "/+#") {
+		http.Error(resp, "Bad Request: Invalid gateway id.", http.StatusBadRequest)
+		return nil
+	}
+	gateway.Connected = false
+	gateway.LastSeen = nil
+	return gateway
+}
+
+////////////////////
+
+func GetGateways(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	connected := ConnectedGateways()
+	gatewaysMutex.Lock()
+	list := make([]*Gateway, 0, len(gateways))
+	for _, gateway := range gateways {
+		list = append(list, gatewayCopy(gateway, connected))
+	}
+	gatewaysMutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	tools.WriteJSON(resp, list)
+}
+
+func CreateGateway(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	gateway := readGateway(resp, req)
+	if gateway == nil {
+		return
+	}
+	if gateway.Id == "" {
+		gateway.Id = uuid.New().String()
+	}
+
+	gatewaysMutex.Lock()
+	_, exists := gateways[gateway.Id]
+	if !exists {
+		gateways[gateway.Id] = gateway
+	}
+	gatewaysMutex.Unlock()
+
+	if exists {
+		http.Error(resp, "Conflict: Gateway exists.", http.StatusConflict)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/plain")
+	resp.Write([]byte(gateway.Id))
+}
+
+func GetGateway(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	connected := ConnectedGateways()
+	gatewaysMutex.Lock()
+	gateway := gateways[params.ByName("gateway_id")]
+	if gateway != nil {
+		gateway = gatewayCopy(gateway, connected)
+	}
+	gatewaysMutex.Unlock()
+
+	if gateway == nil {
+		http.Error(resp, "Not Found: Gateway not found.", http.StatusNotFound)
+		return
+	}
+	tools.WriteJSON(resp, gateway)
+}
+
+func UpdateGateway(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	update := readGateway(resp, req)
+	if update == nil {
+		return
+	}
+
+	gatewaysMutex.Lock()
+	gateway := gateways[params.ByName("gateway_id")]
+	if gateway != nil {
+		gateway.Name = update.Name
+		gateway.Owner = update.Owner
+		gateway.Location = update.Location
+		gateway.SoftwareVersion = update.SoftwareVersion
+	}
+	gatewaysMutex.Unlock()
+
+	if gateway == nil {
+		http.Error(resp, "Not Found: Gateway not found.", http.StatusNotFound)
+		return
+	}
+	resp.Write([]byte("Updated."))
+}
+
+// DeleteGateway removes the gateway, its devices are kept without gateway.
+func DeleteGateway(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	id := params.ByName("gateway_id")
+	gatewaysMutex.Lock()
+	_, ok := gateways[id]
+	delete(gateways, id)
+	gatewaysMutex.Unlock()
+
+	if !ok {
+		http.Error(resp, "Not Found: Gateway not found.", http.StatusNotFound)
+		return
+	}
+	devicesMutex.Lock()
+	for _, device := range devices {
+		if device.GatewayId == id {
+			device.GatewayId = ""
+		}
+	}
+	devicesMutex.Unlock()
+	resp.Write([]byte("Deleted."))
+}
+
+func GetGatewayDevices(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	id := params.ByName("gateway_id")
+	gatewaysMutex.Lock()
+	_, ok := gateways[id]
+	gatewaysMutex.Unlock()
+	if !ok {
+		http.Error(resp, "Not Found: Gateway not found.", http.StatusNotFound)
+		return
+	}
+
+	devicesMutex.Lock()
+	list := []*Device{}
+	for _, device := range devices {
+		if device.GatewayId == id {
+			list = append(list, device)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	data, err := json.Marshal(list)
+	devicesMutex.Unlock()
+
+	if err != nil {
+		http.Error(resp, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(data)
+}
+
+// PostGatewayHeartbeat is sent by gateways, e.g. by MQTT at
+// "gateways/<gateway_id>/heartbeat", as the owner of the gateway. The body
+// may be a JSON object with the software version:
+// {"software_version": "1.2.0"}.
+func PostGatewayHeartbeat(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	data, err := tools.ReadAll(req.Body)
+	if err != nil {
+		http.Error(resp, "Request Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var heartbeat struct {
+		SoftwareVersion string `json:"software_version"`
+	}
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &heartbeat); err != nil {
+			http.Error(resp, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	gatewaysMutex.Lock()
+	gateway := gateways[params.ByName("gateway_id")]
+	owner := gateway != nil && gateway.owns(RequestUser(req))
+	if owner {
+		now := time.Now().UTC()
+		gateway.LastSeen = &now
+		if heartbeat.SoftwareVersion != "" {
+			gateway.SoftwareVersion = heartbeat.SoftwareVersion
+		}
+	}
+	gatewaysMutex.Unlock()
+
+	if gateway == nil {
+		http.Error(resp, "Not Found: Gateway not found.", http.StatusNotFound)
+		return
+	}
+	if !owner {
+		http.Error(resp, "Forbidden: Not the owner of the gateway.", http.StatusForbidden)
+		return
+	}
+	resp.Write([]byte("OK."))
+}
@@ -0,0 +1,295 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/j-forster/Waziup-API/mqtt"
+	"github.com/j-forster/Waziup-API/tools"
+
+	router "github.com/julienschmidt/httprouter"
+)
+
+// Shadow is the state document the server holds for a device that is not
+// always connected. Applications set the desired state, the device reports
+// its state. The difference (the delta) is published retained at
+// "devices/<device_id>/shadow/delta", so the device gets it when it
+// subscribes, and again when it reconnects.
+//
+// The device reports its state at "devices/<device_id>/shadow/reported"
+// (or by POST /devices/:device_id/shadow/reported).
+type Shadow struct {
+	Desired  map[string]interface{} `json:"desired"`
+	Reported map[string]interface{} `json:"reported"`
+	// the time of the last update of every value,
+	// with the structure of desired and reported
+	Metadata ShadowMetadata `json:"metadata"`
+	// incremented by every update
+	Version   int       `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type ShadowMetadata struct {
+	Desired  map[string]interface{} `json:"desired"`
+	Reported map[string]interface{} `json:"reported"`
+}
+
+// shadowDelta is published at "devices/<device_id>/shadow/delta".
+type shadowDelta struct {
+	State     map[string]interface{} `json:"state"`
+	Version   int                    `json:"version"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+var shadows = make(map[string]*Shadow)
+var shadowsMutex sync.Mutex
+
+func newShadow() *Shadow {
+	return &Shadow{
+		Desired:  make(map[string]interface{}),
+		Reported: make(map[string]interface{}),
+		Metadata: ShadowMetadata{
+			Desired:  make(map[string]interface{}),
+			Reported: make(map[string]interface{}),
+		},
+	}
+}
+
+// mergeState applies the patch to the state like a JSON merge patch
+// (RFC 7386): null removes a value, objects are merged. The metadata of
+// the values that are set is the timestamp.
+func mergeState(state, metadata, patch map[string]interface{}, now time.Time) {
+
+	for key, value := range patch {
+		if value == nil {
+			delete(state, key)
+			delete(metadata, key)
+			continue
+		}
+		if obj, ok := value.(map[string]interface{}); ok {
+			s, ok := state[key].(map[string]interface{})
+			if !ok {
+				s = make(map[string]interface{})
+				state[key] = s
+			}
+			m, ok := metadata[key].(map[string]interface{})
+			if _, leaf := m["timestamp"].(time.Time); !ok || leaf {
+				m = make(map[string]interface{})
+				metadata[key] = m
+			}
+			mergeState(s, m, obj, now)
+			continue
+		}
+		state[key] = value
+		metadata[key] = map[string]interface{}{"timestamp": now}
+	}
+}
+
+// delta returns the desired values that differ from the reported values.
+func delta(desired, reported map[string]interface{}) map[string]interface{} {
+
+	d := make(map[string]interface{})
+	for key, value := range desired {
+		if obj, ok := value.(map[string]interface{}); ok {
+			if r, ok := reported[key].(map[string]interface{}); ok {
+				if sub := delta(obj, r); len(sub) != 0 {
+					d[key] = sub
+				}
+				continue
+			}
+		}
+		if !reflect.DeepEqual(value, reported[key]) {
+			d[key] = value
+		}
+	}
+	return d
+}
+
+// deltaMessage returns the delta of the shadow, an empty retained message
+// removes the delta if there is none. The shadowsMutex must be held, but not
+// while the message is published: Publish waits for the server loop.
+// Concurrent updates may publish their deltas out of order, the version
+// tells the device which one is the latest.
+func deltaMessage(deviceId string, shadow *Shadow) *mqtt.Message {
+
+	var payload []byte
+	if d := delta(shadow.Desired, shadow.Reported); len(d) != 0 {
+		payload, _ = json.Marshal(&shadowDelta{
+			State:     d,
+			Version:   shadow.Version,
+			Timestamp: shadow.Timestamp,
+		})
+	}
+	msg := mqtt.NewMessage("devices/"+deviceId+"/shadow/delta", payload, 1, true)
+	if payload != nil {
+		msg.ContentType = "application/json"
+	}
+	return msg
+}
+
+// DeviceConnected publishes the delta of the device shadow again,
+// it is called when the server accepted the MQTT client of the device
+// (the device id as client ID).
+func DeviceConnected(deviceId string) {
+
+	shadowsMutex.Lock()
+	var msg *mqtt.Message
+	if shadow := shadows[deviceId]; shadow != nil {
+		msg = deltaMessage(deviceId, shadow)
+	}
+	shadowsMutex.Unlock()
+
+	if msg != nil {
+		Publish(msg)
+	}
+}
+
+// updateShadow applies the patches of the desired and reported state.
+// A nil patch leaves the state, an empty one (from JSON null) clears it.
+// It writes the response.
+func updateShadow(resp http.ResponseWriter, deviceId string, desired, reported map[string]interface{}, version int) {
+
+	devicesMutex.Lock()
+	_, ok := devices[deviceId]
+	devicesMutex.Unlock()
+	if !ok {
+		http.Error(resp, "Not Found: Device not found.", http.StatusNotFound)
+		return
+	}
+
+	shadowsMutex.Lock()
+
+	shadow := shadows[deviceId]
+	if shadow == nil {
+		shadow = newShadow()
+		shadows[deviceId] = shadow
+	}
+	if version != 0 && version != shadow.Version {
+		shadowsMutex.Unlock()
+		http.Error(resp, "Conflict: Version mismatch.", http.StatusConflict)
+		return
+	}
+
+	now := time.Now().UTC()
+	if desired != nil {
+		if len(desired) == 0 {
+			shadow.Desired = make(map[string]interface{})
+			shadow.Metadata.Desired = make(map[string]interface{})
+		}
+		mergeState(shadow.Desired, shadow.Metadata.Desired, desired, now)
+	}
+	if reported != nil {
+		if len(reported) == 0 {
+			shadow.Reported = make(map[string]interface{})
+			shadow.Metadata.Reported = make(map[string]interface{})
+		}
+		mergeState(shadow.Reported, shadow.Metadata.Reported, reported, now)
+	}
+	shadow.Version++
+	shadow.Timestamp = now
+	msg := deltaMessage(deviceId, shadow)
+	// the response is written after unlocking
+	data, err := json.Marshal(shadow)
+	shadowsMutex.Unlock()
+
+	Publish(msg)
+	if err != nil {
+		http.Error(resp, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(data)
+}
+
+// readPatch reads a JSON object of a shadow update:
+// nil if it is missing, empty if it is null.
+func readPatch(raw json.RawMessage) (map[string]interface{}, error) {
+
+	if raw == nil {
+		return nil, nil
+	}
+	var patch map[string]interface{}
+	if err := json.Unmarshal(raw, &patch); err != nil {
+		return nil, err
+	}
+	if patch == nil {
+		patch = make(map[string]interface{})
+	}
+	return patch, nil
+}
+
+////////////////////
+
+func GetShadow(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	id := params.ByName("device_id")
+	devicesMutex.Lock()
+	_, ok := devices[id]
+	devicesMutex.Unlock()
+	if !ok {
+		http.Error(resp, "Not Found: Device not found.", http.StatusNotFound)
+		return
+	}
+
+	shadowsMutex.Lock()
+	defer shadowsMutex.Unlock()
+
+	shadow := shadows[id]
+	if shadow == nil {
+		shadow = newShadow()
+	}
+	tools.WriteJSON(resp, shadow)
+}
+
+// PatchShadow updates the desired and/or reported state:
+// {"desired": {...}, "reported": {...}, "version": 3}. The version is
+// optional, if it is given it must match the version of the shadow.
+func PatchShadow(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	data, err := tools.ReadAll(req.Body)
+	if err != nil {
+		http.Error(resp, "Request Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var update struct {
+		Desired  json.RawMessage `json:"desired"`
+		Reported json.RawMessage `json:"reported"`
+		Version  int             `json:"version"`
+	}
+	if err := json.Unmarshal(data, &update); err != nil {
+		http.Error(resp, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	desired, err := readPatch(update.Desired)
+	if err != nil {
+		http.Error(resp, "Bad Request: desired: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	reported, err := readPatch(update.Reported)
+	if err != nil {
+		http.Error(resp, "Bad Request: reported: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	updateShadow(resp, params.ByName("device_id"), desired, reported, update.Version)
+}
+
+// PostShadowReported is the reported state of the device, e.g. by MQTT at
+// "devices/<device_id>/shadow/reported". The body is merged into the
+// reported state.
+func PostShadowReported(resp http.ResponseWriter, req *http.Request, params router.Params) {
+
+	data, err := tools.ReadAll(req.Body)
+	if err != nil {
+		http.Error(resp, "Request Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	reported, err := readPatch(data)
+	if err != nil {
+		http.Error(resp, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	updateShadow(resp, params.ByName("device_id"), nil, reported, 0)
+}
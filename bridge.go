@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/j-forster/Waziup-API/logging"
+	"github.com/j-forster/Waziup-API/metrics"
+	"github.com/j-forster/Waziup-API/mqtt"
+	"github.com/j-forster/Waziup-API/mqtt/client"
+)
+
+var logBridge = logging.For("bridge")
+
+// BridgeConfig connects this server to a remote MQTT server (e.g. the cloud
+// broker) and forwards topics in one or both directions. Outgoing messages
+// are buffered while the remote server is unreachable.
+type BridgeConfig struct {
+	Name string `json:"name"`
+	// e.g. "tcp://host:1883", "tls://host:8883" or "wss://host/mqtt"
+	Address  string `json:"address"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// protocol level: 3 (MQTT 3.1), 4 (3.1.1) or 5 (default). Only MQTT 5
+	// carries the hops (see SetHopLimit), the content type, the user
+	// properties and the trace context of the messages.
+	Version      byte `json:"version"`
+	CleanSession bool `json:"clean_session"`
+	// TLS: CA of the remote server (system roots if empty) and client certificate
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+
+	Topics []*BridgeTopic `json:"topics"`
+
+	// directory of the buffer of outgoing messages,
+	// the buffer is kept in memory only if empty
+	BufferDir string `json:"buffer_dir"`
+	// maximum number of buffered messages, the oldest are dropped (default 10000)
+	BufferSize int `json:"buffer_size"`
+	// do not forward the messages that came in through this bridge back
+	// to the remote server (for topics in both directions)
+	NoLocal bool `json:"no_local"`
+}
+
+// BridgeTopic forwards the topics matching LocalPrefix+Pattern to
+// RemotePrefix+Pattern ("out"), the other way round ("in") or "both".
+// The messages are forwarded with at most QoS.
+// A topic that is forwarded in both directions bounces back and forth,
+// unless the bridge is NoLocal, until the hop limit is reached.
+type BridgeTopic struct {
+	Pattern      string `json:"pattern"`
+	Direction    string `json:"direction"`
+	QoS          byte   `json:"qos"`
+	LocalPrefix  string `json:"local_prefix"`
+	RemotePrefix string `json:"remote_prefix"`
+}
+
+func (t *BridgeTopic) out() bool {
+	return t.Direction == "out" || t.Direction == "both"
+}
+
+func (t *BridgeTopic) in() bool {
+	return t.Direction == "in" || t.Direction == "both"
+}
+
+func (cfg *BridgeConfig) version() byte {
+	if cfg.Version == 0 {
+		return 5
+	}
+	return cfg.Version
+}
+
+func (cfg *BridgeConfig) validate() error {
+
+	if cfg.Name == "" {
+		return errors.New("bridge without name")
+	}
+	if cfg.Address == "" {
+		return fmt.Errorf("bridge %q: no address", cfg.Name)
+	}
+	for _, t := range cfg.Topics {
+		if !t.out() && !t.in() {
+			return fmt.Errorf("bridge %q: direction of %q must be \"out\", \"in\" or \"both\"", cfg.Name, t.Pattern)
+		}
+		if t.QoS > 2 {
+			return fmt.Errorf("bridge %q: qos of %q must be 0..2", cfg.Name, t.Pattern)
+		}
+		if t.Pattern == "" {
+			return fmt.Errorf("bridge %q: topic without pattern", cfg.Name)
+		}
+	}
+	if v := cfg.version(); v < 3 || v > 5 {
+		return fmt.Errorf("bridge %q: version must be 3, 4 or 5", cfg.Name)
+	}
+	if _, err := cfg.tlsConfig(); err != nil {
+		return fmt.Errorf("bridge %q: %v", cfg.Name, err)
+	}
+	return nil
+}
+
+// validateBridges checks the bridge configs without starting any bridge.
+func validateBridges(cfgs []*BridgeConfig) error {
+
+	names := make(map[string]bool, len(cfgs))
+	for _, cfg := range cfgs {
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		if names[cfg.Name] {
+			return fmt.Errorf("bridge %q: name used twice", cfg.Name)
+		}
+		names[cfg.Name] = true
+	}
+	return nil
+}
+
+var (
+	bridgeMessages = metrics.NewCounterVec("bridge_messages_total",
+		"Number of messages forwarded by bridges, by direction (in, out) and result (forwarded, dropped).",
+		"bridge", "direction", "result")
+	bridgeBuffered = metrics.NewGaugeVec("bridge_buffered_messages",
+		"Number of outgoing messages waiting for the remote server.", "bridge")
+	bridgeConnected = metrics.NewGaugeVec("bridge_connected",
+		"1 if the bridge is connected to the remote server.", "bridge")
+)
+
+func init() {
+	metrics.Register(bridgeMessages, bridgeBuffered, bridgeConnected)
+}
+
+////////////////////
+
+type bridge struct {
+	cfg    *BridgeConfig
+	client *client.Client
+	buffer *buffer
+	// guards subs and stopping, see addSub()
+	mutex    sync.Mutex
+	subs     []*mqtt.Subscription
+	stopping bool
+	// outgoing messages of the server loop, see push()
+	out chan *mqtt.Message
+	// the client gave up reconnecting, see supervise()
+	gaveUp chan error
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// size of bridge.out, the messages are dropped if the buffer can not
+// keep up with it
+const bridgeQueueSize = 1000
+
+var bridgesMutex sync.Mutex
+var bridges = make(map[string]*bridge)
+
+// configureBridges starts the configured bridges, and stops or restarts
+// the running bridges that were removed or changed.
+func configureBridges(cfgs []*BridgeConfig) error {
+
+	if err := validateBridges(cfgs); err != nil {
+		return err
+	}
+
+	bridgesMutex.Lock()
+	defer bridgesMutex.Unlock()
+
+	wanted := make(map[string]*BridgeConfig)
+	for _, cfg := range cfgs {
+		wanted[cfg.Name] = cfg
+	}
+	for name, b := range bridges {
+		if cfg, ok := wanted[name]; !ok || !sameBridgeConfig(cfg, b.cfg) {
+			b.stop()
+			delete(bridges, name)
+		}
+	}
+	for name, cfg := range wanted {
+		if _, ok := bridges[name]; ok {
+			continue
+		}
+		b, err := startBridge(cfg)
+		if err != nil {
+			return fmt.Errorf("bridge %q: %v", name, err)
+		}
+		bridges[name] = b
+	}
+	return nil
+}
+
+func sameBridgeConfig(a, b *BridgeConfig) bool {
+
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+// stopBridges stops all bridges, at shutdown.
+func stopBridges() {
+
+	bridgesMutex.Lock()
+	defer bridgesMutex.Unlock()
+
+	for name, b := range bridges {
+		b.stop()
+		delete(bridges, name)
+	}
+}
+
+func startBridge(cfg *BridgeConfig) (*bridge, error) {
+
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	size := cfg.BufferSize
+	if size == 0 {
+		size = 10000
+	}
+	buf, err := openBuffer(cfg.BufferDir, size)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bridge{
+		cfg:    cfg,
+		buffer: buf,
+		out:    make(chan *mqtt.Message, bridgeQueueSize),
+		gaveUp: make(chan error, 1),
+		done:   make(chan struct{}),
+	}
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = "bridge-" + cfg.Name
+	}
+	b.client, err = client.New(cfg.Address, &client.Options{
+		ClientID:     clientID,
+		Username:     cfg.Username,
+		Password:     cfg.Password,
+		Version:      cfg.version(),
+		CleanSession: cfg.CleanSession,
+		TLSConfig:    tlsConfig,
+		Reconnect:    true,
+		Logger:       logBridge.With("bridge", cfg.Name),
+		OnConnect: func(c *client.Client, sessionPresent bool) {
+			bridgeConnected.With(cfg.Name).Set(1)
+		},
+		OnConnectionLost: func(c *client.Client, err error) {
+			bridgeConnected.With(cfg.Name).Set(0)
+		},
+		OnReconnectFailed: func(c *client.Client, err error) {
+			giveUp(b.gaveUp, err)
+		},
+	})
+	if err != nil {
+		buf.Close()
+		return nil, err
+	}
+	bridgeBuffered.With(cfg.Name).Set(float64(buf.Len()))
+
+	var ctx context.Context
+	ctx, b.cancel = context.WithCancel(context.Background())
+	go b.run(ctx)
+	return b, nil
+}
+
+func (cfg *BridgeConfig) tlsConfig() (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	return tlsConfig, nil
+}
+
+func (b *bridge) run(ctx context.Context) {
+
+	defer close(b.done)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		b.store(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		supervise(ctx, b.client, b.gaveUp, logBridge.With("bridge", b.cfg.Name))
+	}()
+
+	// buffer the outgoing messages from the start, while connecting
+	for _, t := range b.cfg.Topics {
+		if t.out() {
+			t := t
+			sub := mqttServer.SubscribeFunc(t.LocalPrefix+t.Pattern, t.QoS, func(msg *mqtt.Message) {
+				b.push(t, msg)
+			})
+			if sub != nil && !b.addSub(sub) {
+				mqttServer.Unsubscribe(sub)
+			}
+		}
+	}
+
+	for _, t := range b.cfg.Topics {
+		if t.in() {
+			if !b.subscribe(ctx, t) {
+				return
+			}
+		}
+	}
+	forward(ctx, b.client, b.buffer, b.sent)
+}
+
+// addSub keeps the local subscription for stop(),
+// it returns false if the bridge is stopping.
+func (b *bridge) addSub(sub *mqtt.Subscription) bool {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.stopping {
+		return false
+	}
+	b.subs = append(b.subs, sub)
+	return true
+}
+
+// subscribe subscribes to the remote topics, the client renews the
+// subscription when it reconnects.
+func (b *bridge) subscribe(ctx context.Context, t *BridgeTopic) bool {
+
+	for {
+		err := b.client.Subscribe(ctx, t.RemotePrefix+t.Pattern, t.QoS, func(msg *mqtt.Message) {
+			b.receive(t, msg)
+		})
+		if err == nil {
+			return true
+		}
+		if err != client.NotConnected {
+			logBridge.Warn("bridge subscribe failed", "bridge", b.cfg.Name, "topic", t.RemotePrefix+t.Pattern, "error", err)
+		}
+		var e *mqtt.Error
+		if errors.As(err, &e) {
+			// refused by the remote server
+			return true
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// push queues an outgoing message for store(), it is called from the server
+// loop and must not wait for the disk.
+func (b *bridge) push(t *BridgeTopic, msg *mqtt.Message) {
+
+	if b.cfg.NoLocal && msg.Origin.Transport == "bridge" && msg.Origin.ClientID == b.cfg.Name {
+		return
+	}
+	qos := msg.QoS
+	if t.QoS < qos {
+		qos = t.QoS
+	}
+	topic := t.RemotePrefix + strings.TrimPrefix(msg.Topic, t.LocalPrefix)
+	out := mqtt.NewMessage(topic, msg.Buf, qos, msg.Retain())
+	out.ContentType = msg.ContentType
+	out.UserProperties = msg.UserProperties
+	out.Origin = msg.Origin.Hop()
+	select {
+	case b.out <- out:
+	default:
+		bridgeMessages.With(b.cfg.Name, "out", "dropped").Inc()
+	}
+}
+
+// store writes the outgoing messages to the buffer until ctx is done,
+// then it closes the buffer.
+func (b *bridge) store(ctx context.Context) {
+
+	defer b.buffer.Close()
+	for {
+		select {
+		case msg := <-b.out:
+			if !b.buffer.Push(msg) {
+				bridgeMessages.With(b.cfg.Name, "out", "dropped").Inc()
+			}
+			bridgeBuffered.With(b.cfg.Name).Set(float64(b.buffer.Len()))
+		case <-ctx.Done():
+			// keep what is queued for the next start
+			for {
+				select {
+				case msg := <-b.out:
+					b.buffer.Push(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *bridge) sent(msg *mqtt.Message, err error) {
+
+	if err == nil {
+		bridgeMessages.With(b.cfg.Name, "out", "forwarded").Inc()
+	} else {
+		logBridge.Warn("message refused", "bridge", b.cfg.Name, "topic", msg.Topic, "error", err)
+		bridgeMessages.With(b.cfg.Name, "out", "dropped").Inc()
+	}
+	bridgeBuffered.With(b.cfg.Name).Set(float64(b.buffer.Len()))
+}
+
+// forward publishes the buffered messages to the remote server in order,
+// until ctx is done. sent is called when a message left the buffer, with an
+// error if the remote server refused it (retries would fail too).
+func forward(ctx context.Context, c *client.Client, buf *buffer, sent func(msg *mqtt.Message, err error)) {
+
+	for {
+		msg := buf.Peek()
+		if msg == nil {
+			return
+		}
+		err := c.Publish(ctx, msg)
+		if ctx.Err() != nil {
+			return
+		}
+		var e *mqtt.Error
+		if err != nil && !errors.As(err, &e) {
+			// not connected, try again later
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		buf.Pop(msg)
+		sent(msg, err)
+	}
+}
+
+// supervise connects the client again when it gives up reconnecting (see
+// client.Refused), e.g. while the credentials at the remote server are being
+// changed, until ctx is done. gaveUp receives the errors of
+// client.Options.OnReconnectFailed, see giveUp().
+func supervise(ctx context.Context, c *client.Client, gaveUp <-chan error, log *slog.Logger) {
+
+	backoff := superviseMinBackoff
+	for {
+		err := c.Connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			backoff = superviseMinBackoff
+			select {
+			case err = <-gaveUp:
+			case <-ctx.Done():
+				return
+			}
+		}
+		log.Error("remote server refused the connection", "error", err, "retry", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > superviseMaxBackoff {
+			backoff = superviseMaxBackoff
+		}
+	}
+}
+
+const (
+	superviseMinBackoff = 10 * time.Second
+	superviseMaxBackoff = 10 * time.Minute
+)
+
+// giveUp is the client.Options.OnReconnectFailed of supervised clients.
+func giveUp(gaveUp chan<- error, err error) {
+
+	select {
+	case gaveUp <- err:
+	default:
+	}
+}
+
+// receive publishes an incoming message at the local server.
+func (b *bridge) receive(t *BridgeTopic, msg *mqtt.Message) {
+
+	qos := msg.QoS
+	if t.QoS < qos {
+		qos = t.QoS
+	}
+	topic := t.LocalPrefix + strings.TrimPrefix(msg.Topic, t.RemotePrefix)
+	in := mqtt.NewMessage(topic, msg.Buf, qos, msg.Retain())
+	in.UserProperties = msg.UserProperties
+	in.ContentType = msg.ContentType
+	// the hops of the remote server, if it passed them on
+	in.Origin = mqtt.Origin{Transport: "bridge", ClientID: b.cfg.Name, Hops: msg.Origin.Hops + 1}
+	mqttServer.Publish(nil, in)
+	bridgeMessages.With(b.cfg.Name, "in", "forwarded").Inc()
+}
+
+func (b *bridge) stop() {
+
+	// no more messages for push(), then store() keeps the queued ones in
+	// the buffer and closes it
+	b.mutex.Lock()
+	b.stopping = true
+	subs := b.subs
+	b.subs = nil
+	b.mutex.Unlock()
+	for _, sub := range subs {
+		mqttServer.Unsubscribe(sub)
+	}
+	b.cancel()
+	b.client.Close()
+	<-b.done
+	bridgeConnected.With(b.cfg.Name).Set(0)
+}
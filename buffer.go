@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/j-forster/Waziup-API/mqtt"
+)
+
+// buffer is a FIFO queue of messages that is kept in a file, so that the
+// messages survive a restart. The file is appended to, and the offset of the
+// first message is kept in a second file. The offset is saved every
+// offsetInterval messages and when the buffer is closed, so after a crash
+// up to offsetInterval messages are sent again. The sent messages at the
+// start of the file are removed once they take compactSize bytes and more
+// than half of the file.
+//
+// Records: 4 bytes length, 1 byte flags (QoS, 0x04 for retain), 2 bytes
+// topic length, topic, MQTT 5 properties (see mqtt.MessageProperties),
+// payload.
+type buffer struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	msgs  []*mqtt.Message
+	sizes []int64 // record sizes of msgs
+	max   int
+
+	// nil if the buffer is in memory only
+	file       *os.File
+	fileName   string
+	offsetFile string
+	offset     int64
+	end        int64 // size of the file
+	unsaved    int   // messages popped since the offset was saved
+
+	closed bool
+}
+
+const (
+	offsetInterval = 100
+	compactSize    = 1 << 20
+)
+
+// openBuffer opens the buffer in the directory, or in memory if dir is empty.
+// If the buffer is full, the oldest message is dropped.
+func openBuffer(dir string, max int) (*buffer, error) {
+
+	b := &buffer{max: max}
+	b.cond = sync.NewCond(&b.mutex)
+	if dir == "" {
+		return b, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	b.offsetFile = filepath.Join(dir, "offset")
+	b.fileName = filepath.Join(dir, "messages")
+	data, err := os.ReadFile(b.offsetFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) != 0 {
+		if b.offset, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, err
+		}
+	}
+
+	b.file, err = os.OpenFile(b.fileName, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.load(); err != nil {
+		b.file.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// load reads the messages after the offset. An incomplete record at the end
+// (from a crash while writing) is cut off.
+func (b *buffer) load() error {
+
+	info, err := b.file.Stat()
+	if err != nil {
+		return err
+	}
+	if b.offset > info.Size() {
+		// the file was compacted before the offset was saved
+		b.offset = 0
+	}
+	if _, err := b.file.Seek(b.offset, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(b.file)
+	end := b.offset
+	for {
+		var head [4]byte
+		if _, err := io.ReadFull(reader, head[:]); err != nil {
+			break
+		}
+		length := binary.BigEndian.Uint32(head[:])
+		record := make([]byte, length)
+		if _, err := io.ReadFull(reader, record); err != nil {
+			break
+		}
+		msg := decodeRecord(record)
+		if msg == nil {
+			break
+		}
+		b.msgs = append(b.msgs, msg)
+		b.sizes = append(b.sizes, int64(4+length))
+		end += int64(4 + length)
+	}
+	if err := b.file.Truncate(end); err != nil {
+		return err
+	}
+	b.end = end
+	_, err = b.file.Seek(end, io.SeekStart)
+	return err
+}
+
+func encodeRecord(msg *mqtt.Message) []byte {
+
+	flags := msg.QoS
+	if msg.Retain() {
+		flags |= 0x04
+	}
+	record := make([]byte, 4, 4+1+2+len(msg.Topic)+len(msg.Buf))
+	record = append(record, flags, byte(len(msg.Topic)>>8), byte(len(msg.Topic)))
+	record = append(record, msg.Topic...)
+	record = mqtt.AppendProperties(record, mqtt.MessageProperties(msg))
+	record = append(record, msg.Buf...)
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+	return record
+}
+
+func decodeRecord(record []byte) *mqtt.Message {
+
+	if len(record) < 3 {
+		return nil
+	}
+	l := int(record[1])<<8 | int(record[2])
+	if len(record) < 3+l {
+		return nil
+	}
+	flags := record[0]
+	n, props, err := mqtt.ReadProperties(record[3+l:])
+	if err != nil {
+		return nil
+	}
+	msg := mqtt.NewMessage(string(record[3:3+l]), record[3+l+n:], flags&0x03, flags&0x04 != 0)
+	msg.SetProperties(props)
+	return msg
+}
+
+// Push appends the message, it returns false if the oldest message
+// was dropped to make room.
+func (b *buffer) Push(msg *mqtt.Message) bool {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return false
+	}
+	ok := true
+	if b.max != 0 && len(b.msgs) >= b.max {
+		b.pop()
+		ok = false
+	}
+	size := int64(0)
+	if b.file != nil {
+		record := encodeRecord(msg)
+		if _, err := b.file.Write(record); err != nil {
+			logBridge.Error("buffer write failed", "file", b.fileName, "error", err)
+		}
+		size = int64(len(record))
+		b.end += size
+	}
+	b.msgs = append(b.msgs, msg)
+	b.sizes = append(b.sizes, size)
+	b.cond.Signal()
+	return ok
+}
+
+// Peek waits for the first message, it returns nil when the buffer is closed.
+func (b *buffer) Peek() *mqtt.Message {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for len(b.msgs) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return nil
+	}
+	return b.msgs[0]
+}
+
+// Pop removes the message if it is still the first one, it is not if the
+// buffer was full and dropped it meanwhile.
+func (b *buffer) Pop(msg *mqtt.Message) {
+
+	b.mutex.Lock()
+	if len(b.msgs) != 0 && b.msgs[0] == msg {
+		b.pop()
+	}
+	b.mutex.Unlock()
+}
+
+// pop removes the first message, the mutex must be held.
+func (b *buffer) pop() {
+
+	b.offset += b.sizes[0]
+	b.msgs[0] = nil
+	b.msgs = b.msgs[1:]
+	b.sizes = b.sizes[1:]
+	if b.file == nil || b.closed {
+		return
+	}
+	if b.offset >= compactSize && b.offset*2 > b.end {
+		b.compact()
+		return
+	}
+	b.unsaved++
+	if b.unsaved >= offsetInterval {
+		b.saveOffset()
+	}
+}
+
+// saveOffset writes the offset file, the mutex must be held.
+func (b *buffer) saveOffset() {
+
+	if err := os.WriteFile(b.offsetFile, []byte(strconv.FormatInt(b.offset, 10)), 0o600); err != nil {
+		logBridge.Error("buffer write failed", "file", b.offsetFile, "error", err)
+	}
+	b.unsaved = 0
+}
+
+// compact copies the messages after the offset to a new file, the mutex
+// must be held. The offset is reset before the new file replaces the old
+// one, a crash in between sends the old messages again but loses none.
+func (b *buffer) compact() {
+
+	tmp, err := os.OpenFile(b.fileName+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		logBridge.Error("buffer compaction failed", "file", b.fileName, "error", err)
+		b.saveOffset()
+		return
+	}
+	_, err = io.Copy(tmp, io.NewSectionReader(b.file, b.offset, b.end-b.offset))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		logBridge.Error("buffer compaction failed", "file", b.fileName, "error", err)
+		b.saveOffset()
+		return
+	}
+	offset := b.offset
+	b.offset = 0
+	b.saveOffset()
+	if err := os.Rename(tmp.Name(), b.fileName); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		logBridge.Error("buffer compaction failed", "file", b.fileName, "error", err)
+		b.offset = offset
+		b.saveOffset()
+		return
+	}
+	b.file.Close()
+	b.file = tmp
+	b.end -= offset
+}
+
+// Len returns the number of messages in the buffer.
+func (b *buffer) Len() int {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.msgs)
+}
+
+// Close releases Peek(), the messages stay in the file.
+func (b *buffer) Close() error {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.cond.Broadcast()
+	if b.file != nil {
+		if b.unsaved != 0 {
+			b.saveOffset()
+		}
+		return b.file.Close()
+	}
+	return nil
+}
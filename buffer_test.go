@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/j-forster/Waziup-API/mqtt"
+)
+
+func testMessage(i int, payload []byte) *mqtt.Message {
+
+	msg := mqtt.NewMessage(fmt.Sprintf("devices/d%d/value", i), payload, byte(i%3), i%2 == 0)
+	msg.ContentType = "text/plain"
+	msg.UserProperties = []mqtt.UserProperty{{Key: "i", Value: fmt.Sprint(i)}}
+	msg.Origin.Hops = i
+	return msg
+}
+
+func sameMessage(a, b *mqtt.Message) bool {
+
+	if a.Topic != b.Topic || !bytes.Equal(a.Buf, b.Buf) || a.QoS != b.QoS || a.Retain() != b.Retain() ||
+		a.ContentType != b.ContentType || a.Origin.Hops != b.Origin.Hops || len(a.UserProperties) != len(b.UserProperties) {
+		return false
+	}
+	for i := range a.UserProperties {
+		if a.UserProperties[i] != b.UserProperties[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBuffer(t *testing.T) {
+
+	for _, dir := range []string{"", t.TempDir()} {
+		b, err := openBuffer(dir, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if !b.Push(testMessage(i, []byte("v"))) {
+				t.Fatalf("dir %q: message %d dropped", dir, i)
+			}
+		}
+		first := b.Peek()
+		if !sameMessage(first, testMessage(0, []byte("v"))) {
+			t.Fatalf("dir %q: first %+v", dir, first)
+		}
+		// full: the oldest message is dropped while it is being sent
+		if b.Push(testMessage(3, []byte("v"))) {
+			t.Fatalf("dir %q: full buffer took the message", dir)
+		}
+		b.Pop(first)
+		if n := b.Len(); n != 3 {
+			t.Fatalf("dir %q: pop of a dropped message, %d messages left", dir, n)
+		}
+		for i := 1; i <= 3; i++ {
+			msg := b.Peek()
+			if !sameMessage(msg, testMessage(i, []byte("v"))) {
+				t.Fatalf("dir %q: message %d is %+v", dir, i, msg)
+			}
+			b.Pop(msg)
+		}
+		if n := b.Len(); n != 0 {
+			t.Fatalf("dir %q: %d messages left", dir, n)
+		}
+		b.Close()
+		if msg := b.Peek(); msg != nil {
+			t.Fatalf("dir %q: peek after close", dir)
+		}
+	}
+}
+
+func TestBufferRestart(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		push   int
+		pop    int
+		cutOff bool // a crash while writing the last record
+	}{
+		{"empty", 0, 0, false},
+		{"unsent", 5, 0, false},
+		{"sent", 5, 2, false},
+		{"all sent", 5, 5, false},
+		{"more than the offset interval", offsetInterval + 10, offsetInterval + 5, false},
+		{"incomplete record", 5, 1, true},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		b, err := openBuffer(dir, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < test.push; i++ {
+			b.Push(testMessage(i, []byte("v")))
+		}
+		for i := 0; i < test.pop; i++ {
+			b.Pop(b.Peek())
+		}
+		b.Close()
+		if test.cutOff {
+			f, err := os.OpenFile(filepath.Join(dir, "messages"), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(encodeRecord(testMessage(99, []byte("v")))[:10])
+			f.Close()
+		}
+
+		b, err = openBuffer(dir, 1000)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if n := b.Len(); n != test.push-test.pop {
+			t.Fatalf("%s: %d messages after the restart, want %d", test.name, n, test.push-test.pop)
+		}
+		b.Push(testMessage(100, []byte("v")))
+		for i := test.pop; i < test.push; i++ {
+			msg := b.Peek()
+			if !sameMessage(msg, testMessage(i, []byte("v"))) {
+				t.Fatalf("%s: message %d is %+v", test.name, i, msg)
+			}
+			b.Pop(msg)
+		}
+		if msg := b.Peek(); !sameMessage(msg, testMessage(100, []byte("v"))) {
+			t.Fatalf("%s: message pushed after the restart is %+v", test.name, msg)
+		}
+		b.Close()
+	}
+}
+
+func TestBufferCompact(t *testing.T) {
+
+	dir := t.TempDir()
+	b, err := openBuffer(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, 64<<10)
+	const n = 40
+	for i := 0; i < n; i++ {
+		b.Push(testMessage(i, payload))
+	}
+	const sent = 30
+	for i := 0; i < sent; i++ {
+		b.Pop(b.Peek())
+	}
+	b.Close()
+
+	info, err := os.Stat(filepath.Join(dir, "messages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// compacted once more than half of the file was sent
+	if info.Size() >= n*int64(len(payload))/2 {
+		t.Fatalf("file of %d bytes was not compacted", info.Size())
+	}
+
+	b, err = openBuffer(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for i := sent; i < n; i++ {
+		msg := b.Peek()
+		if !sameMessage(msg, testMessage(i, payload)) {
+			t.Fatalf("message %d is %s", i, msg.Topic)
+		}
+		b.Pop(msg)
+	}
+}
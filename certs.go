@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// certReloader serves the TLS certificate to new connections and can reload
+// it from its files without restarting the listeners.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload reads the certificate files again. The old certificate is kept on error.
+func (cr *certReloader) Reload() error {
+
+	pair, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mutex.Lock()
+	cr.cert = &pair
+	cr.mutex.Unlock()
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	return cr.cert, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+var errCertRevoked = errors.New("client certificate has been revoked")
+
+// clientAuth verifies TLS client certificates against a CA bundle and an
+// optional certificate revocation list. The CRL is read again on reload().
+type clientAuth struct {
+	mode    tls.ClientAuthType
+	pool    *x509.CertPool
+	cas     []*x509.Certificate
+	crlFile string
+
+	mutex   sync.RWMutex
+	revoked map[string]struct{} // issuer + serial number
+}
+
+func newClientAuth(mode string, caFile string, crlFile string) (*clientAuth, error) {
+
+	ca := &clientAuth{crlFile: crlFile}
+
+	switch mode {
+	case "optional":
+		ca.mode = tls.VerifyClientCertIfGiven
+	case "require":
+		ca.mode = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth mode %q", mode)
+	}
+
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ca.cas = append(ca.cas, cert)
+	}
+	if len(ca.cas) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	ca.pool = x509.NewCertPool()
+	for _, cert := range ca.cas {
+		ca.pool.AddCert(cert)
+	}
+
+	if err := ca.Reload(); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// Apply enables client certificate verification for the TLS config.
+func (ca *clientAuth) Apply(cfg *tls.Config) {
+
+	cfg.ClientAuth = ca.mode
+	cfg.ClientCAs = ca.pool
+	cfg.VerifyPeerCertificate = ca.verify
+}
+
+// Reload reads the CRL file again. The old list is kept on error.
+func (ca *clientAuth) Reload() error {
+
+	if ca.crlFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(ca.crlFile)
+	if err != nil {
+		return err
+	}
+
+	var ders [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		// not PEM encoded
+		ders = append(ders, data)
+	}
+
+	revoked := make(map[string]struct{})
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return err
+		}
+		if err := ca.checkCRLSignature(crl); err != nil {
+			return err
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[string(crl.RawIssuer)+entry.SerialNumber.String()] = struct{}{}
+		}
+	}
+
+	ca.mutex.Lock()
+	ca.revoked = revoked
+	ca.mutex.Unlock()
+	return nil
+}
+
+func (ca *clientAuth) checkCRLSignature(crl *x509.RevocationList) error {
+
+	for _, cert := range ca.cas {
+		if string(cert.RawSubject) == string(crl.RawIssuer) {
+			return crl.CheckSignatureFrom(cert)
+		}
+	}
+	return errors.New("CRL is not issued by a configured CA")
+}
+
+// verify is called after the chain has been verified against the CA bundle.
+func (ca *clientAuth) verify(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+
+	ca.mutex.RLock()
+	defer ca.mutex.RUnlock()
+
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if _, ok := ca.revoked[string(cert.RawIssuer)+cert.SerialNumber.String()]; ok {
+				return errCertRevoked
+			}
+		}
+	}
+	return nil
+}
+
+////////////////////
+
+// devicePrefix starts the user name of a device that authenticated with its
+// client certificate, e.g. "device:cam-1" (see devicePrincipal).
+const devicePrefix = "device:"
+
+// devicePrincipal is the user of a device for the ACL and the limits. The
+// names of configured users can not start with devicePrefix, so a device
+// never gets the rights of a user with the same name as its certificate.
+func devicePrincipal(device string) string {
+	return devicePrefix + device
+}
+
+// clientIdentity returns the device identity of a verified client certificate:
+// the Common Name, or the first DNS or URI Subject Alternative Name.
+// It returns "" if the client did not present a verified certificate.
+func clientIdentity(state *tls.ConnectionState) string {
+
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) != 0 {
+		return cert.DNSNames[0]
+	}
+	if len(cert.URIs) != 0 {
+		return cert.URIs[0].String()
+	}
+	return ""
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/j-forster/Waziup-API/logging"
+	"github.com/j-forster/Waziup-API/metrics"
+	"github.com/j-forster/Waziup-API/mqtt"
+	"github.com/j-forster/Waziup-API/mqtt/client"
+)
+
+var logCluster = logging.For("cluster")
+
+// ClusterConfig joins this server with other instances. Every node connects
+// to every other node (full mesh) as a MQTT client:
+//
+//   - it subscribes there to the topic filters of its own clients,
+//     so a message is routed only to the nodes that have subscribers,
+//   - it publishes its retained messages there, so they are replicated,
+//     all of them whenever it connects to the node,
+//   - it announces its new clients, so a client that reconnects to a
+//     different node is disconnected from the old one (the server keeps
+//     no session state after a disconnect, so there is nothing else to
+//     hand over).
+type ClusterConfig struct {
+	// name of this node, unique in the cluster
+	Node string `json:"node"`
+	// shared secret the nodes authenticate with
+	Secret string `json:"secret"`
+	// MQTT addresses of all other nodes, e.g. "tcp://10.0.0.2:1883"
+	Peers []string `json:"peers"`
+}
+
+// validate checks the config, nil (no cluster) is valid.
+func (cfg *ClusterConfig) validate() error {
+
+	if cfg == nil {
+		return nil
+	}
+	if cfg.Node == "" || cfg.Secret == "" {
+		return errors.New("cluster: node and secret are required")
+	}
+	for _, addr := range cfg.Peers {
+		if addr == "" {
+			return errors.New("cluster: peer without address")
+		}
+	}
+	return nil
+}
+
+const (
+	// user name of the nodes, the client id is "$cluster/<node>"
+	clusterUser = "$cluster"
+	// topics of the nodes among each other, not published to clients
+	clusterTopics = "$cluster/"
+	// Origin.Transport of the messages that came from another node,
+	// clients can not set it
+	clusterTransport = "cluster"
+)
+
+var clusterPeers = metrics.NewGaugeVec("cluster_peer_connected",
+	"1 if this node is connected to the peer.", "peer")
+
+func init() {
+	metrics.Register(clusterPeers)
+}
+
+////////////////////
+
+// interest counts the topic filters of the local clients (not of other nodes).
+type interest struct {
+	mutex   sync.Mutex
+	filters map[string]int
+	conns   map[*mqtt.Connection]map[string]bool
+}
+
+var localInterest = &interest{
+	filters: make(map[string]int),
+	conns:   make(map[*mqtt.Connection]map[string]bool),
+}
+
+// add returns true if the filter is new.
+func (in *interest) add(conn *mqtt.Connection, filter string) bool {
+
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	subs := in.conns[conn]
+	if subs == nil {
+		subs = make(map[string]bool)
+		in.conns[conn] = subs
+	}
+	if subs[filter] {
+		return false
+	}
+	subs[filter] = true
+	in.filters[filter]++
+	return in.filters[filter] == 1
+}
+
+// remove returns true if no client has the filter any more.
+func (in *interest) remove(conn *mqtt.Connection, filter string) bool {
+
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	return in.removeLocked(conn, filter)
+}
+
+func (in *interest) removeLocked(conn *mqtt.Connection, filter string) bool {
+
+	subs := in.conns[conn]
+	if !subs[filter] {
+		return false
+	}
+	delete(subs, filter)
+	if len(subs) == 0 {
+		delete(in.conns, conn)
+	}
+	in.filters[filter]--
+	if in.filters[filter] == 0 {
+		delete(in.filters, filter)
+		return true
+	}
+	return false
+}
+
+// removeConn returns true if filters are gone.
+func (in *interest) removeConn(conn *mqtt.Connection) bool {
+
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	changed := false
+	for filter := range in.conns[conn] {
+		if in.removeLocked(conn, filter) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (in *interest) snapshot() map[string]bool {
+
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	filters := make(map[string]bool, len(in.filters))
+	for filter := range in.filters {
+		filters[filter] = true
+	}
+	return filters
+}
+
+////////////////////
+
+type clusterNode struct {
+	cfg   *ClusterConfig
+	peers []*peer
+}
+
+// peer is the connection of this node to another node.
+type peer struct {
+	addr   string
+	client *client.Client
+	// retained messages and announcements for the peer
+	buffer *buffer
+	// signals that the interest changed or the peer connected
+	sync chan struct{}
+	// filters subscribed at the peer, only used by syncInterest()
+	subscribed map[string]bool
+	// the client gave up reconnecting, see supervise()
+	gaveUp chan error
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var clusterMutex sync.Mutex
+var cluster atomic.Pointer[clusterNode]
+
+// configureCluster joins the cluster, or leaves it if cfg is nil.
+// A changed configuration reconnects to all peers.
+func configureCluster(cfg *ClusterConfig) error {
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	clusterMutex.Lock()
+	defer clusterMutex.Unlock()
+
+	old := cluster.Load()
+	if old != nil && cfg != nil {
+		ja, _ := json.Marshal(old.cfg)
+		jb, _ := json.Marshal(cfg)
+		if string(ja) == string(jb) {
+			return nil
+		}
+	}
+	if old != nil {
+		cluster.Store(nil)
+		old.stop()
+	}
+	if cfg == nil {
+		return nil
+	}
+
+	node := &clusterNode{cfg: cfg}
+	for _, addr := range cfg.Peers {
+		p, err := node.connect(addr)
+		if err != nil {
+			node.stop()
+			return err
+		}
+		node.peers = append(node.peers, p)
+	}
+	cluster.Store(node)
+	logCluster.Info("cluster joined", "node", cfg.Node, "peers", len(cfg.Peers))
+	return nil
+}
+
+// stopCluster leaves the cluster, at shutdown.
+func stopCluster() {
+	configureCluster(nil)
+}
+
+func (node *clusterNode) connect(addr string) (*peer, error) {
+
+	buf, _ := openBuffer("", 10000)
+	p := &peer{
+		addr:       addr,
+		buffer:     buf,
+		sync:       make(chan struct{}, 1),
+		subscribed: make(map[string]bool),
+		gaveUp:     make(chan error, 1),
+	}
+	var err error
+	p.client, err = client.New(addr, &client.Options{
+		ClientID:     clusterTopics + node.cfg.Node,
+		Username:     clusterUser,
+		Password:     node.cfg.Secret,
+		CleanSession: true,
+		Reconnect:    true,
+		Version:      5, // carries the hops, user properties and trace context
+		Logger:       logCluster.With("peer", addr),
+		OnConnect: func(c *client.Client, sessionPresent bool) {
+			clusterPeers.With(addr).Set(1)
+			p.syncRetained()
+			p.signal()
+		},
+		OnConnectionLost: func(c *client.Client, err error) {
+			clusterPeers.With(addr).Set(0)
+		},
+		OnReconnectFailed: func(c *client.Client, err error) {
+			giveUp(p.gaveUp, err)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+	p.wg.Add(3)
+	go func() {
+		defer p.wg.Done()
+		supervise(ctx, p.client, p.gaveUp, logCluster.With("peer", addr))
+	}()
+	go func() {
+		defer p.wg.Done()
+		forward(ctx, p.client, p.buffer, func(msg *mqtt.Message, err error) {
+			if err != nil {
+				logCluster.Warn("message refused by peer", "peer", addr, "topic", msg.Topic, "error", err)
+			}
+		})
+	}()
+	go func() {
+		defer p.wg.Done()
+		p.syncInterest(ctx)
+	}()
+	return p, nil
+}
+
+func (node *clusterNode) stop() {
+
+	for _, p := range node.peers {
+		p.cancel()
+		p.buffer.Close()
+		p.client.Close()
+		p.wg.Wait()
+		clusterPeers.With(p.addr).Set(0)
+	}
+}
+
+// notify tells the peers that the local interest changed.
+func (node *clusterNode) notify() {
+
+	for _, p := range node.peers {
+		p.signal()
+	}
+}
+
+// push sends the message to all peers.
+func (node *clusterNode) push(msg *mqtt.Message) {
+
+	for _, p := range node.peers {
+		if !p.buffer.Push(msg) {
+			logCluster.Warn("peer buffer full, message dropped", "peer", p.addr)
+		}
+	}
+}
+
+// syncRetained sends the retained messages of this node to the peer, which
+// missed them if it joined or restarted later.
+func (p *peer) syncRetained() {
+
+	n := 0
+	for _, msg := range mqttServer.Retained() {
+		if fromCluster(msg) || strings.HasPrefix(msg.Topic, clusterTopics) {
+			continue
+		}
+		if !p.buffer.Push(mqtt.NewMessage(msg.Topic, msg.Buf, msg.QoS, true)) {
+			logCluster.Warn("peer buffer full, message dropped", "peer", p.addr)
+		}
+		n++
+	}
+	logCluster.Debug("retained messages sent to peer", "peer", p.addr, "count", n)
+}
+
+func (p *peer) signal() {
+
+	select {
+	case p.sync <- struct{}{}:
+	default:
+	}
+}
+
+// syncInterest subscribes at the peer to the filters of the local clients.
+// The client renews the subscriptions when it reconnects.
+func (p *peer) syncInterest(ctx context.Context) {
+
+	for {
+		select {
+		case <-p.sync:
+		case <-ctx.Done():
+			return
+		}
+		filters := localInterest.snapshot()
+		for filter := range filters {
+			if p.subscribed[filter] {
+				continue
+			}
+			if err := p.client.Subscribe(ctx, filter, 2, p.receive); err != nil {
+				// again when connected
+				logCluster.Debug("peer subscribe failed", "peer", p.addr, "topic", filter, "error", err)
+				break
+			}
+			p.subscribed[filter] = true
+		}
+		for filter := range p.subscribed {
+			if filters[filter] {
+				continue
+			}
+			if err := p.client.Unsubscribe(ctx, filter); err != nil {
+				logCluster.Debug("peer unsubscribe failed", "peer", p.addr, "topic", filter, "error", err)
+				break
+			}
+			delete(p.subscribed, filter)
+		}
+	}
+}
+
+// receive publishes a message of the peer to the local clients.
+func (p *peer) receive(msg *mqtt.Message) {
+
+	msg.Origin = mqtt.Origin{Transport: clusterTransport, ClientID: p.addr, Hops: msg.Origin.Hops}
+	mqttServer.Publish(nil, msg)
+}
+
+////////////////////
+
+// clusterLink tells if the connection is another node of the cluster.
+func clusterLink(conn *mqtt.Connection) bool {
+
+	return linkNode(conn) != ""
+}
+
+// linkNode returns the name of the node of the connection.
+func linkNode(conn *mqtt.Connection) string {
+
+	node, _ := conn.Get("cluster").(string)
+	return node
+}
+
+// clusterAuth checks the credentials of a node and returns its name.
+func clusterAuth(clientID, password string) (string, bool) {
+
+	node := cluster.Load()
+	if node == nil || !strings.HasPrefix(clientID, clusterTopics) {
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(node.cfg.Secret)) != 1 {
+		return "", false
+	}
+	return strings.TrimPrefix(clientID, clusterTopics), true
+}
+
+// fromCluster tells if the message came from another node.
+func fromCluster(msg *mqtt.Message) bool {
+
+	return msg.Origin.Transport == clusterTransport
+}
+
+// clusterInterceptor must be the last interceptor,
+// so that it sees only what the others accepted.
+type clusterInterceptor struct {
+	mqtt.NopInterceptor
+}
+
+func (clusterInterceptor) OnConnect(conn *mqtt.Connection, username, password string) error {
+
+	if node := cluster.Load(); node != nil && !clusterLink(conn) {
+		// disconnects the client at the other nodes
+		node.push(mqtt.NewMessage(clusterTopics+"connected", []byte(conn.ClientID), 1, false))
+	}
+	return nil
+}
+
+func (clusterInterceptor) OnSubscribe(conn *mqtt.Connection, topic string, qos byte) error {
+
+	if !clusterLink(conn) && localInterest.add(conn, topic) {
+		if node := cluster.Load(); node != nil {
+			node.notify()
+		}
+	}
+	return nil
+}
+
+func (clusterInterceptor) OnUnsubscribe(conn *mqtt.Connection, topic string) error {
+
+	if localInterest.remove(conn, topic) {
+		if node := cluster.Load(); node != nil {
+			node.notify()
+		}
+	}
+	return nil
+}
+
+func (clusterInterceptor) OnDisconnect(conn *mqtt.Connection) {
+
+	if localInterest.removeConn(conn) {
+		if node := cluster.Load(); node != nil {
+			node.notify()
+		}
+	}
+}
+
+func (clusterInterceptor) OnPublish(conn *mqtt.Connection, msg *mqtt.Message) error {
+
+	if conn != nil && clusterLink(conn) {
+		if strings.HasPrefix(msg.Topic, clusterTopics) {
+			handleClusterMessage(conn, msg)
+			return mqtt.Consumed
+		}
+		// a retained message replicated by the node
+		msg.Origin = mqtt.Origin{Transport: clusterTransport, ClientID: linkNode(conn), Hops: msg.Origin.Hops}
+		return nil
+	}
+	if msg.Retain() && !fromCluster(msg) {
+		if node := cluster.Load(); node != nil {
+			node.push(mqtt.NewMessage(msg.Topic, msg.Buf, msg.QoS, true))
+		}
+	}
+	return nil
+}
+
+func (clusterInterceptor) OnDeliver(conn *mqtt.Connection, msg *mqtt.Message) (*mqtt.Message, error) {
+
+	// Nodes get only the messages published at this node, other nodes send
+	// their messages themselves. Retained messages are pushed by OnPublish.
+	if clusterLink(conn) && (msg.Retain() || fromCluster(msg)) {
+		return nil, mqtt.Consumed
+	}
+	return msg, nil
+}
+
+func handleClusterMessage(conn *mqtt.Connection, msg *mqtt.Message) {
+
+	switch strings.TrimPrefix(msg.Topic, clusterTopics) {
+	case "connected":
+		clientID := string(msg.Buf)
+		for _, c := range mqttServer.Connections() {
+			if c.ClientID == clientID && !clusterLink(c) {
+				logCluster.Info("client connected at another node", "client", clientID, "node", linkNode(conn))
+				c.Disconnect(mqtt.SESSION_TAKEN_OVER)
+			}
+		}
+	default:
+		logCluster.Warn("unknown cluster message", "topic", msg.Topic, "node", linkNode(conn))
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+
+	"github.com/j-forster/Waziup-API/logging"
+	"github.com/j-forster/Waziup-API/mqtt"
+)
+
+// Config is the part of the server configuration that can be changed
+// at runtime (see reload()). It is read from the JSON file given with -config.
+type Config struct {
+	// "debug", "info", "warn" or "error", defaults to -log-level
+	LogLevel string `json:"log_level"`
+	// levels of individual subsystems: "main", "http", "ws", "mqtt", "api"
+	LogLevels map[string]string `json:"log_levels"`
+	// if no users are configured, anyone can connect
+	Users []*User `json:"users"`
+	// if no rules are configured, all topics are accessible
+	ACL []*ACLRule `json:"acl"`
+	// rate limits and quotas, see limits.go
+	Limits Limits `json:"limits"`
+	// maximum MQTT packet size by listener ("mqtt", "mqtts", "ws", "wss"),
+	// "*" for all listeners, up to 268435455 (256 MB), defaults to 15360
+	MaxPacketSize map[string]int `json:"max_packet_size"`
+	// bridges to remote MQTT servers, see bridge.go
+	Bridges []*BridgeConfig `json:"bridges"`
+	// other instances of the server, see cluster.go
+	Cluster *ClusterConfig `json:"cluster"`
+	// origins of browser apps, see cors.go
+	CORS CORSConfig `json:"cors"`
+	// REST requests that publish MQTT messages, see publish.go
+	RESTEvents []*RESTEvent `json:"rest_events"`
+	// messages that passed more bridges (HTTP/MQTT or remote servers) are
+	// dropped as loops, defaults to 8
+	HopLimit int `json:"hop_limit"`
+	// clients do not get their own messages back from a bridge, e.g. the
+	// REST event of a request they made over MQTT
+	NoLocal bool `json:"no_local"`
+}
+
+type User struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Admin    bool   `json:"admin"`
+}
+
+// ACLRule grants a user (or everyone with "*") access to the topics matching
+// a MQTT topic filter. Access is "read", "write" or "readwrite".
+type ACLRule struct {
+	User   string `json:"user"`
+	Topic  string `json:"topic"`
+	Access string `json:"access"`
+}
+
+// access modes for Config.Allowed()
+const (
+	READ  = 1
+	WRITE = 2
+)
+
+var configFile string
+var logLevel string
+var config atomic.Value // *Config
+
+func init() {
+	config.Store(&Config{})
+}
+
+func currentConfig() *Config {
+	return config.Load().(*Config)
+}
+
+func loadConfig(file string) (*Config, error) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate checks the whole config, including the bridges and the cluster,
+// without applying anything.
+func (cfg *Config) validate(level string) error {
+
+	for _, user := range cfg.Users {
+		if strings.HasPrefix(user.Name, devicePrefix) {
+			return fmt.Errorf("user %q: names starting with %q are devices", user.Name, devicePrefix)
+		}
+	}
+	for listener, size := range cfg.MaxPacketSize {
+		if size <= 0 || size > mqtt.MaxRemainingLength {
+			return fmt.Errorf("max packet size of %q must be 1..%d", listener, mqtt.MaxRemainingLength)
+		}
+	}
+	if err := cfg.CORS.validate(); err != nil {
+		return err
+	}
+	if err := validateRESTEvents(cfg.RESTEvents); err != nil {
+		return err
+	}
+	if cfg.HopLimit < 0 {
+		return fmt.Errorf("hop limit must not be negative")
+	}
+	if err := logging.CheckLevels(level, cfg.LogLevels); err != nil {
+		return err
+	}
+	if err := validateBridges(cfg.Bridges); err != nil {
+		return err
+	}
+	return cfg.Cluster.validate()
+}
+
+// applyConfig makes cfg the active configuration.
+// An invalid config changes nothing. If a bridge or the cluster can not be
+// started (e.g. the buffer directory), the bridges and the cluster of the
+// current config are restored.
+func applyConfig(cfg *Config) error {
+
+	level := cfg.LogLevel
+	if level == "" {
+		level = logLevel
+	}
+	if err := cfg.validate(level); err != nil {
+		return err
+	}
+
+	// on errors the bridges and the cluster of the old configuration are
+	// restored, what can not be restored is logged
+	old := currentConfig()
+	if err := configureBridges(cfg.Bridges); err != nil {
+		if rerr := configureBridges(old.Bridges); rerr != nil {
+			logMain.Error("restoring the bridges failed", "error", rerr)
+		}
+		return err
+	}
+	if err := configureCluster(cfg.Cluster); err != nil {
+		if rerr := configureCluster(old.Cluster); rerr != nil {
+			logMain.Error("restoring the cluster failed", "error", rerr)
+		}
+		if rerr := configureBridges(old.Bridges); rerr != nil {
+			logMain.Error("restoring the bridges failed", "error", rerr)
+		}
+		return err
+	}
+	logging.SetLevels(level, cfg.LogLevels)
+	mqttServer.SetMaxPacketSize(cfg.MaxPacketSize)
+	mqttServer.SetHopLimit(cfg.HopLimit)
+	mqttServer.SetNoLocal(cfg.NoLocal)
+	config.Store(cfg)
+	return nil
+}
+
+////////////////////
+
+// Authenticate checks the credentials against the configured users.
+// The returned user is nil if the credentials are wrong, or if there are no
+// users configured at all (ok is true in that case).
+func (cfg *Config) Authenticate(name, password string) (user *User, ok bool) {
+
+	if len(cfg.Users) == 0 {
+		return nil, true
+	}
+	for _, user := range cfg.Users {
+		if user.Name == name && subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1 {
+			return user, true
+		}
+	}
+	return nil, false
+}
+
+// User returns the user with the name, nil if there is none.
+// Device principals are never users.
+func (cfg *Config) User(name string) *User {
+
+	if strings.HasPrefix(name, devicePrefix) {
+		return nil
+	}
+	for _, user := range cfg.Users {
+		if user.Name == name {
+			return user
+		}
+	}
+	return nil
+}
+
+// Allowed tells if the user may read (subscribe) or write (publish) the topic.
+// For READ the topic may be a topic filter with wildcards.
+func (cfg *Config) Allowed(user string, topic string, access int) bool {
+
+	if len(cfg.ACL) == 0 {
+		return true
+	}
+	for _, rule := range cfg.ACL {
+		if rule.User != "*" && rule.User != user {
+			continue
+		}
+		if rule.access()&access == 0 {
+			continue
+		}
+		if mqtt.Match(rule.Topic, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *ACLRule) access() int {
+	switch rule.Access {
+	case "read":
+		return READ
+	case "write":
+		return WRITE
+	case "readwrite":
+		return READ | WRITE
+	}
+	return 0
+}
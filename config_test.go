@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+
+	bridge := func(name string) *BridgeConfig {
+		return &BridgeConfig{Name: name, Address: "tcp://remote:1883",
+			Topics: []*BridgeTopic{{Pattern: "#", Direction: "out"}}}
+	}
+	tests := []struct {
+		name string
+		cfg  *Config
+		ok   bool
+	}{
+		{"empty", &Config{}, true},
+		{"max packet size", &Config{MaxPacketSize: map[string]int{"*": 0}}, false},
+		{"hop limit", &Config{HopLimit: -1}, false},
+		{"log level", &Config{LogLevels: map[string]string{"http": "loud"}}, false},
+		{"rest event", &Config{RESTEvents: []*RESTEvent{{Route: "x", Method: "PUBLISH"}}}, false},
+		{"bridges", &Config{Bridges: []*BridgeConfig{bridge("a"), bridge("b")}}, true},
+		{"bridge names", &Config{Bridges: []*BridgeConfig{bridge("a"), bridge("a")}}, false},
+		{"bridge version", &Config{Bridges: []*BridgeConfig{{Name: "a", Address: "x", Version: 6}}}, false},
+		{"bridge ca file", &Config{Bridges: []*BridgeConfig{{Name: "a", Address: "x", CAFile: "/nonexistent"}}}, false},
+		{"cluster", &Config{Cluster: &ClusterConfig{Node: "a", Secret: "s", Peers: []string{"tcp://b:1883"}}}, true},
+		{"cluster secret", &Config{Cluster: &ClusterConfig{Node: "a"}}, false},
+		{"cluster peer", &Config{Cluster: &ClusterConfig{Node: "a", Secret: "s", Peers: []string{""}}}, false},
+	}
+	for _, test := range tests {
+		if err := test.cfg.validate("info"); (err == nil) != test.ok {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+
+	if !(&Config{}).Allowed("anyone", "a/b", WRITE) {
+		t.Fatal("no ACL must allow everything")
+	}
+	cfg := &Config{ACL: []*ACLRule{
+		{User: "*", Topic: "public/#", Access: "read"},
+		{User: "alice", Topic: "devices/alice/#", Access: "readwrite"},
+		{User: "bob", Topic: "devices/+/value", Access: "write"},
+		{User: "bob", Topic: "bob/#", Access: "rw"}, // unknown access grants nothing
+	}}
+	tests := []struct {
+		user    string
+		topic   string
+		access  int
+		allowed bool
+	}{
+		{"carol", "public/news", READ, true},
+		{"carol", "public/news", WRITE, false},
+		{"carol", "public/#", READ, true},
+		{"carol", "#", READ, false},
+		{"alice", "public", READ, true},
+		{"alice", "devices/alice/temp", WRITE, true},
+		{"alice", "devices/alice/temp", READ, true},
+		{"alice", "devices/alice/#", READ, true},
+		{"alice", "devices/#", READ, false},
+		{"alice", "devices/+/temp", READ, false},
+		{"alice", "devices/bob/temp", READ, false},
+		{"bob", "devices/x/value", WRITE, true},
+		{"bob", "devices/x/value", READ, false},
+		{"bob", "devices/x/y/value", WRITE, false},
+		{"bob", "bob/x", READ, false},
+		{"", "devices/alice/temp", WRITE, false},
+	}
+	for _, test := range tests {
+		if allowed := cfg.Allowed(test.user, test.topic, test.access); allowed != test.allowed {
+			t.Errorf("%q %q access %d: allowed %v, want %v", test.user, test.topic, test.access, allowed, test.allowed)
+		}
+	}
+}
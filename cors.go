@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig lets browser apps of other origins (like the dashboard) use
+// the REST API and the MQTT WebSocket.
+type CORSConfig struct {
+	// allowed origins, e.g. "https://dashboard.example.com", "*" for all
+	// origins, or "https://*.example.com" for the subdomains of a host (with
+	// the same scheme and port). Requests of the same origin and of
+	// non-browser clients (no Origin header) are always allowed.
+	Origins []string `json:"origins"`
+	// methods and request headers of cross-origin requests,
+	// default "GET, HEAD, POST, PUT, PATCH, DELETE" and "Authorization, Content-Type"
+	Methods []string `json:"methods"`
+	Headers []string `json:"headers"`
+	// allow cookies and the Authorization header (credentials) with
+	// cross-origin requests
+	Credentials bool `json:"credentials"`
+	// seconds that browsers may cache a preflight result, 0 for the
+	// browser default
+	MaxAge int `json:"max_age"`
+}
+
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+var defaultCORSHeaders = []string{"Authorization", "Content-Type"}
+
+func (cfg *CORSConfig) validate() error {
+
+	for _, origin := range cfg.Origins {
+		if origin == "*" {
+			continue
+		}
+		scheme, host, ok := strings.Cut(origin, "://")
+		if !ok || scheme == "" || host == "" || strings.ContainsAny(host, "/?#@") ||
+			strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return fmt.Errorf("cors: bad origin %q: must be \"*\" or scheme://host[:port], the host may start with \"*.\"", origin)
+		}
+	}
+	if cfg.MaxAge < 0 {
+		return fmt.Errorf("cors: max_age must not be negative")
+	}
+	return nil
+}
+
+// allowOrigin tells if the origin matches one of the configured origins.
+func (cfg *CORSConfig) allowOrigin(origin string) bool {
+
+	origin = strings.ToLower(origin)
+	for _, pattern := range cfg.Origins {
+		if matchOrigin(strings.ToLower(pattern), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin matches an origin ("https://a.example.com") to a pattern of
+// CORSConfig.Origins. Unlike paths, a wildcard host matches subdomains of any
+// depth, but never the host itself.
+func matchOrigin(pattern, origin string) bool {
+
+	if pattern == "*" {
+		return true
+	}
+	pscheme, phost, _ := strings.Cut(pattern, "://")
+	oscheme, ohost, ok := strings.Cut(origin, "://")
+	if !ok || pscheme != oscheme {
+		return false
+	}
+	if suffix, ok := strings.CutPrefix(phost, "*."); ok {
+		// the port is part of the suffix
+		return strings.HasSuffix(ohost, "."+suffix) && len(ohost) > len(suffix)+1
+	}
+	return phost == ohost
+}
+
+// sameOrigin tells if the Origin header names the host of the request.
+func sameOrigin(req *http.Request) bool {
+
+	u, err := url.Parse(req.Header.Get("Origin"))
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+// checkOrigin is the origin policy of WebSocket upgrades.
+func checkOrigin(req *http.Request) bool {
+
+	origin := req.Header.Get("Origin")
+	if origin == "" || sameOrigin(req) {
+		return true
+	}
+	if currentConfig().CORS.allowOrigin(origin) {
+		return true
+	}
+	logWS.Warn("origin not allowed", "origin", origin, "remote", req.RemoteAddr)
+	return false
+}
+
+// handleCORS adds the CORS headers to responses for allowed origins and
+// answers preflight requests. It returns true if the request was answered.
+func handleCORS(resp http.ResponseWriter, req *http.Request) bool {
+
+	origin := req.Header.Get("Origin")
+	if origin == "" || sameOrigin(req) {
+		return false
+	}
+	cfg := &currentConfig().CORS
+	preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+
+	header := resp.Header()
+	header.Add("Vary", "Origin")
+	if !cfg.allowOrigin(origin) {
+		if preflight {
+			http.Error(resp, "Forbidden: Origin not allowed.", http.StatusForbidden)
+			return true
+		}
+		// the browser will not hand out the response
+		return false
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if cfg.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		return false
+	}
+
+	methods := cfg.Methods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	headers := cfg.Headers
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	header.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if cfg.MaxAge != 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(cfg.MaxAge))
+	}
+	resp.WriteHeader(http.StatusNoContent)
+	return true
+}
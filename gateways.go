@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/j-forster/Waziup-API/api"
+	"github.com/j-forster/Waziup-API/mqtt"
+)
+
+// gatewayInterceptor tracks the MQTT clients of gateways (see api.Gateway):
+// the client ID is the gateway id and the client must authenticate as the
+// owner of the gateway. Connecting, disconnecting and publishing update the
+// last seen time of the gateway, and the devices without gateway it publishes
+// for are associated with it (see api.AssociateDevice).
+// Devices that connect themselves (the client ID is the device id) get the
+// delta of their shadow again (see api.Shadow).
+type gatewayInterceptor struct {
+	mqtt.NopInterceptor
+}
+
+func init() {
+	api.ConnectedGateways = connectedGateways
+}
+
+// gateway returns the gateway id of the connection, "" if it is not the
+// client of a gateway.
+func gateway(conn *mqtt.Connection) string {
+	id, _ := conn.Get("gateway").(string)
+	return id
+}
+
+func connectedGateways() map[string]bool {
+
+	gateways := make(map[string]bool)
+	for _, conn := range mqttServer.Connections() {
+		if id := gateway(conn); id != "" && !conn.ConnectedSince().IsZero() {
+			gateways[id] = true
+		}
+	}
+	return gateways
+}
+
+func (gatewayInterceptor) OnConnect(conn *mqtt.Connection, username, password string) error {
+	if !clusterLink(conn) && api.GatewaySeen(conn.ClientID, connUser(conn)) {
+		conn.Set("gateway", conn.ClientID)
+		logMQTT.Info("gateway connected", "gateway", conn.ClientID)
+	}
+	return nil
+}
+
+func (gatewayInterceptor) OnConnected(conn *mqtt.Connection) {
+	if !clusterLink(conn) {
+		api.DeviceConnected(conn.ClientID)
+	}
+}
+
+func (gatewayInterceptor) OnDisconnect(conn *mqtt.Connection) {
+	if id := gateway(conn); id != "" && api.GatewaySeen(id, connUser(conn)) {
+		logMQTT.Info("gateway disconnected", "gateway", id)
+	}
+}
+
+func (gatewayInterceptor) OnPublish(conn *mqtt.Connection, msg *mqtt.Message) error {
+	if conn == nil {
+		return nil
+	}
+	id := gateway(conn)
+	if id == "" || !api.GatewaySeen(id, connUser(conn)) {
+		return nil
+	}
+	// "devices/<device_id>/..."
+	if rest, ok := strings.CutPrefix(msg.Topic, "devices/"); ok {
+		if device, _, _ := strings.Cut(rest, "/"); device != "" && !api.AssociateDevice(id, device) {
+			logMQTT.Debug("device not associated with the gateway", "gateway", id, "device", device)
+		}
+	}
+	return nil
+}
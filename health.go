@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	routing "github.com/julienschmidt/httprouter"
+)
+
+// listenerState tells if a configured listener is accepting connections.
+type listenerState struct {
+	addr  string
+	bound bool
+	err   error
+}
+
+var listenerStates = make(map[string]*listenerState)
+var listenerStatesMutex sync.Mutex
+
+// configureListener announces a listener that must be bound for readiness.
+func configureListener(name, addr string) {
+
+	listenerStatesMutex.Lock()
+	listenerStates[name] = &listenerState{addr: addr}
+	listenerStatesMutex.Unlock()
+}
+
+// setListenerState records that the listener got bound or stopped (err).
+func setListenerState(name string, bound bool, err error) {
+
+	listenerStatesMutex.Lock()
+	if state, ok := listenerStates[name]; ok {
+		state.bound = bound
+		state.err = err
+	}
+	listenerStatesMutex.Unlock()
+}
+
+////////////////////
+
+type componentHealth struct {
+	Status string `json:"status"`
+	Addr   string `json:"addr,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type health struct {
+	Status     string                      `json:"status"`
+	Components map[string]*componentHealth `json:"components,omitempty"`
+}
+
+////////////////////
+
+func GetHealthLive(resp http.ResponseWriter, req *http.Request, params routing.Params) {
+
+	writeHealth(resp, &health{Status: "up"}, true)
+}
+
+// storagePingTimeout limits the storage check of GetHealthReady.
+const storagePingTimeout = 2 * time.Second
+
+func GetHealthReady(resp http.ResponseWriter, req *http.Request, params routing.Params) {
+
+	h := &health{
+		Status:     "up",
+		Components: make(map[string]*componentHealth),
+	}
+
+	if shuttingDown() {
+		h.Components["server"] = &componentHealth{Status: "down", Error: "shutting down"}
+	}
+
+	if mqttServer.Alive() {
+		h.Components["mqtt"] = &componentHealth{Status: "up"}
+	} else {
+		h.Components["mqtt"] = &componentHealth{Status: "down", Error: "server loop stopped"}
+	}
+
+	if storage := mqttServer.Storage(); storage != nil {
+		ctx, cancel := context.WithTimeout(req.Context(), storagePingTimeout)
+		if err := storage.Ping(ctx); err != nil {
+			h.Components["storage"] = &componentHealth{Status: "down", Error: err.Error()}
+		} else {
+			h.Components["storage"] = &componentHealth{Status: "up"}
+		}
+		cancel()
+	}
+
+	listenerStatesMutex.Lock()
+	for name, state := range listenerStates {
+		c := &componentHealth{Status: "up", Addr: state.addr}
+		if !state.bound {
+			c.Status = "down"
+			if state.err != nil {
+				c.Error = state.err.Error()
+			} else {
+				c.Error = "not bound"
+			}
+		}
+		h.Components["listener:"+name] = c
+	}
+	listenerStatesMutex.Unlock()
+
+	ready := true
+	for _, c := range h.Components {
+		if c.Status != "up" {
+			ready = false
+		}
+	}
+	if !ready {
+		h.Status = "down"
+	}
+	writeHealth(resp, h, ready)
+}
+
+func writeHealth(resp http.ResponseWriter, h *health, ok bool) {
+
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		http.Error(resp, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if !ok {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+	resp.Write(data)
+}
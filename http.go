@@ -1,26 +1,31 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/j-forster/Waziup-API/logging"
 	"github.com/j-forster/Waziup-API/mqtt"
 )
 
+var logHTTP = logging.For("http")
+var logWS = logging.For("ws")
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin:     checkOrigin,
 }
 
-func checkOrigin(r *http.Request) bool {
-	return true
-}
-
 func ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 
 	req.Header.Set("X-Secure", "false")
@@ -37,54 +42,109 @@ func ServeHTTPS(resp http.ResponseWriter, req *http.Request) {
 
 ////////////////////
 
-type wsWrapper struct {
+// wsConn adapts a WebSocket to a MQTT connection. The binary messages are
+// read as one stream, so a packet may be split across messages or a message
+// may hold several packets. Every packet is written as one message.
+type wsConn struct {
 	conn   *websocket.Conn
-	wc     io.WriteCloser
-	head   mqtt.FixedHeader
-	remain int
+	reader io.Reader // of the current message
 }
 
-func (w *wsWrapper) Close() error {
-	return w.conn.Close()
+var errTextMessage = errors.New("unexpected text message")
+
+func (ws *wsConn) Read(p []byte) (int, error) {
+
+	for {
+		if ws.reader == nil {
+			messageType, reader, err := ws.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				return 0, errTextMessage
+			}
+			ws.reader = reader
+		}
+		n, err := ws.reader.Read(p)
+		if err == io.EOF {
+			ws.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
 }
 
-func (w *wsWrapper) Write(data []byte) (int, error) {
+func (ws *wsConn) Write(data []byte) (int, error) {
 
-	if w.remain == 0 {
-		w.wc, _ = w.conn.NextWriter(websocket.BinaryMessage)
-		l, _ := w.head.ReadMessage(data)
-		w.remain = l + w.head.Length
+	if err := ws.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return 0, err
 	}
+	return len(data), nil
+}
+
+// WritePacket implements mqtt.PacketWriter.
+func (ws *wsConn) WritePacket(parts ...[]byte) error {
 
-	w.remain -= len(data)
-	_, err := w.wc.Write(data)
-	if w.remain == 0 {
-		w.wc.Close()
+	w, err := ws.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
 	}
-	return len(data), err
+	for _, data := range parts {
+		if _, err := w.Write(data); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func (ws *wsConn) Close() error {
+	return ws.conn.Close()
 }
 
+// subprotocols of MQTT over WebSocket: "mqtt" (MQTT 3.1.1 and 5) and "mqttv3.1"
+var wsProtocols = []string{"mqtt", "mqttv3.1"}
+
 ////////////////////
 
 func serveHTTP(resp http.ResponseWriter, req *http.Request) {
 
+	// the device id is only trusted from a verified client certificate
+	req.Header.Del("X-Device-Id")
+	if device := clientIdentity(req.TLS); device != "" {
+		req.Header.Set("X-Device-Id", device)
+	}
+
 	if req.Header.Get("Upgrade") != "websocket" {
 
 		Serve(resp, req) // see main.go
 	} else {
 
-		proto := req.Header.Get("Sec-WebSocket-Protocol")
-		if proto != "mqttv3.1" {
-			http.Error(resp, "Requires WebSocket Protocol Header 'mqttv3.1'.", http.StatusBadRequest)
+		// the first protocol of the client that we support
+		var proto string
+	PROTOCOLS:
+		for _, p := range websocket.Subprotocols(req) {
+			for _, supported := range wsProtocols {
+				if p == supported {
+					proto = p
+					break PROTOCOLS
+				}
+			}
+		}
+		if proto == "" {
+			http.Error(resp, "Requires WebSocket Protocol Header 'mqtt' or 'mqttv3.1'.", http.StatusBadRequest)
 			return
 		}
 
 		responseHeader := make(http.Header)
-		responseHeader.Set("Sec-WebSocket-Protocol", "mqttv3.1")
+		responseHeader.Set("Sec-WebSocket-Protocol", proto)
 
 		conn, err := upgrader.Upgrade(resp, req, responseHeader)
 		if err != nil {
-			log.Printf("[%s] (%s) WebSocket Upgrade Failed\n %v", req.Header.Get("X-Tag"), req.RemoteAddr, err)
+			logWS.Warn("upgrade failed", "tag", req.Header.Get("X-Tag"), "remote", req.RemoteAddr, "error", err)
 			return
 		}
 
@@ -95,64 +155,104 @@ func serveHTTP(resp http.ResponseWriter, req *http.Request) {
 			tag = "WS   "
 		}
 
-		wrapper := wsWrapper{conn: conn}
-		mqttConn := mqtt.NewConnection(&wrapper, &wrapper, mqttServer)
-
-		for {
-			messageType, msg, err := conn.ReadMessage()
-			if err != nil {
-				log.Printf("[%s] (%s) WebSocket Read Error\n %v", tag, conn.RemoteAddr().String(), err)
-				//mqttConn.Close()
-				conn.Close() // obsolete
-				return
-			}
-
-			if messageType != websocket.BinaryMessage {
-				log.Printf("[%s] (%s) WebSocket Error:\n Unexpected TEXT message.", tag, conn.RemoteAddr().String())
-				mqttConn.Close()
-				conn.Close() // obsolete
-				return
-			}
-
-			mqttConn.ReadMessage(msg)
-			/*
-				if err := conn.WriteMessage(messageType, msg); err != nil {
-					log.Printf("[%s] (%s) WebSocket Write Error\n %v", tag, conn.RemoteAddr().String(), err)
-					return
-				}
-			*/
-
+		ws := &wsConn{conn: conn}
+		mqttConn := mqtt.NewConnection(ws, ws, mqttServer)
+		mqttConn.TLS = req.TLS
+		mqttConn.Listener = strings.ToLower(strings.TrimSpace(tag))
+		mqttConn.RemoteAddr = req.RemoteAddr
+		defer mqttConn.Close()
+
+		// the packet size is checked by Read() before the payload is read
+		reader := bufio.NewReader(ws)
+		for mqttConn.Alive() {
+			mqttConn.Read(reader)
 		}
+		logWS.Info("closed", "tag", tag, "remote", conn.RemoteAddr().String())
 	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// listen addresses, see main()
+var httpAddr, httpsAddr string
+
 func ListenAndServeHTTP() {
 
-	log.Println("[HTTP ] HTTP Server at \":80\". Use \"http://\".")
-	log.Println("[WS   ] MQTT via WebSocket Server at \":80\". Use \"ws://\".")
-	err := http.ListenAndServe(":80", http.HandlerFunc(ServeHTTP))
+	srv := &http.Server{
+		Addr:    httpAddr,
+		Handler: http.HandlerFunc(ServeHTTP),
+	}
+	addHTTPServer(srv)
+
+	listener, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
-		log.Println("[HTTP ] Error:")
-		log.Fatalln(err)
+		setListenerState("http", false, err)
+		logging.Fatal(logHTTP, "HTTP server failed", "addr", srv.Addr, "error", err)
+	}
+	setListenerState("http", true, nil)
+
+	logHTTP.Info("HTTP server listening, use \"http://\" and \"ws://\"", "addr", srv.Addr)
+	err = srv.Serve(listener)
+	setListenerState("http", false, err)
+	if err != nil && err != http.ErrServerClosed {
+		logging.Fatal(logHTTP, "HTTP server failed", "addr", srv.Addr, "error", err)
 	}
 }
 
 func ListenAndServeHTTPS(cfg *tls.Config) {
 
 	srv := &http.Server{
-		Addr:         ":443",
+		Addr:         httpsAddr,
 		Handler:      http.HandlerFunc(ServeHTTPS),
 		TLSConfig:    cfg,
 		ReadTimeout:  time.Minute,
 		WriteTimeout: time.Minute,
 	}
+	addHTTPServer(srv)
 
-	log.Println("[HTTPS] HTTPS Server at \":443\". Use \"https://\".")
-	log.Println("[WSS  ] MQTT via WebSocket Server at \":443\".  Use \"wss://\".")
-	err := srv.ListenAndServeTLS("", "")
+	listener, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
-		log.Fatalln("[HTTPS] Error:\n", err)
+		setListenerState("https", false, err)
+		logging.Fatal(logHTTP, "HTTPS server failed", "addr", srv.Addr, "error", err)
+	}
+	setListenerState("https", true, nil)
+
+	logHTTP.Info("HTTPS server listening, use \"https://\" and \"wss://\"", "addr", srv.Addr)
+	err = srv.ServeTLS(listener, "", "")
+	setListenerState("https", false, err)
+	if err != nil && err != http.ErrServerClosed {
+		logging.Fatal(logHTTP, "HTTPS server failed", "addr", srv.Addr, "error", err)
+	}
+}
+
+var httpServers []*http.Server
+var httpServersMutex sync.Mutex
+
+func addHTTPServer(srv *http.Server) {
+
+	httpServersMutex.Lock()
+	httpServers = append(httpServers, srv)
+	httpServersMutex.Unlock()
+}
+
+// shutdownHTTP stops all HTTP servers and waits for active requests to finish.
+// Hijacked WebSocket connections are not tracked by http.Server, they are
+// closed by the MQTT server shutdown.
+func shutdownHTTP(ctx context.Context) {
+
+	httpServersMutex.Lock()
+	servers := httpServers
+	httpServersMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			if err := srv.Shutdown(ctx); err != nil {
+				logHTTP.Warn("shutdown incomplete", "addr", srv.Addr, "error", err)
+			}
+			wg.Done()
+		}(srv)
 	}
+	wg.Wait()
 }
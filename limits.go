@@ -0,0 +1,238 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/j-forster/Waziup-API/metrics"
+	"github.com/j-forster/Waziup-API/mqtt"
+)
+
+// Limits protect the server from clients that flood it.
+// Zero values mean unlimited.
+type Limits struct {
+	// rates of a single client: a MQTT client ID, or a device or IP for HTTP
+	ClientMessages float64 `json:"client_messages_per_second"`
+	ClientBytes    float64 `json:"client_bytes_per_second"`
+	// rates of all clients of a user (or device) together
+	UserMessages float64 `json:"user_messages_per_second"`
+	UserBytes    float64 `json:"user_bytes_per_second"`
+	// subscriptions of a MQTT connection, applies to new connections
+	MaxSubscriptions int `json:"max_subscriptions"`
+	// concurrent MQTT connections
+	MaxUserConnections int `json:"max_connections_per_user"`
+	MaxIPConnections   int `json:"max_connections_per_ip"`
+}
+
+var limited = metrics.NewCounterVec("limits_exceeded_total",
+	"Number of messages, requests and connections refused by the limits.", "limit")
+
+func init() {
+	metrics.Register(limited)
+}
+
+////////////////////
+
+// bucket is a token bucket that holds one second of its rate.
+// It may go into debt, so that a single message larger than the rate
+// passes but blocks the following ones.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) fill(rate float64, now time.Time) {
+
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > rate {
+			b.tokens = rate
+		}
+	}
+	b.last = now
+}
+
+type rateEntry struct {
+	messages bucket
+	bytes    bucket
+}
+
+// rateLimiter keeps the buckets of clients and users.
+type rateLimiter struct {
+	mutex     sync.Mutex
+	entries   map[string]*rateEntry
+	lastSweep time.Time
+}
+
+var rates = &rateLimiter{entries: make(map[string]*rateEntry)}
+
+// rate is a limit of allow(), zero rates are unlimited.
+type rate struct {
+	key      string
+	messages float64
+	bytes    float64
+	// metrics label if the limit is exceeded
+	limit string
+}
+
+// allow takes one message of size bytes from the buckets of the rates.
+// If one of them is empty nothing is taken, so that a refused message
+// does not count against the other rates.
+func (rl *rateLimiter) allow(size int, limits ...rate) bool {
+
+	now := time.Now()
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if now.Sub(rl.lastSweep) > time.Minute {
+		// idle buckets are full, they can be created again
+		for k, e := range rl.entries {
+			if now.Sub(e.messages.last) > time.Minute && now.Sub(e.bytes.last) > time.Minute {
+				delete(rl.entries, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	entries := make([]*rateEntry, len(limits))
+	for i, r := range limits {
+		if r.messages == 0 && r.bytes == 0 {
+			continue
+		}
+		e, ok := rl.entries[r.key]
+		if !ok {
+			e = new(rateEntry)
+			rl.entries[r.key] = e
+		}
+		if r.messages != 0 {
+			e.messages.fill(r.messages, now)
+			if e.messages.tokens <= 0 {
+				limited.With(r.limit).Inc()
+				return false
+			}
+		}
+		if r.bytes != 0 {
+			e.bytes.fill(r.bytes, now)
+			if e.bytes.tokens <= 0 {
+				limited.With(r.limit).Inc()
+				return false
+			}
+		}
+		entries[i] = e
+	}
+	for _, e := range entries {
+		if e != nil {
+			e.messages.tokens--
+			e.bytes.tokens -= float64(size)
+		}
+	}
+	return true
+}
+
+// allowMessage applies the client and the user rates to a message.
+// The user may be empty for anonymous clients.
+func allowMessage(client, user string, size int) bool {
+
+	limits := &currentConfig().Limits
+	clientRate := rate{"client:" + client, limits.ClientMessages, limits.ClientBytes, "client_rate"}
+	if user == "" {
+		return rates.allow(size, clientRate)
+	}
+	userRate := rate{"user:" + user, limits.UserMessages, limits.UserBytes, "user_rate"}
+	return rates.allow(size, clientRate, userRate)
+}
+
+// allowRequest applies the rates to a HTTP request. The client is the device
+// of the client certificate or the IP, the user is the device or the
+// (verified) user of the Basic credentials.
+func allowRequest(req *http.Request, size int) bool {
+
+	device := req.Header.Get("X-Device-Id")
+	client, user := device, ""
+	if device != "" {
+		user = devicePrincipal(device)
+	} else {
+		client = remoteHost(req.RemoteAddr)
+		if name, password, ok := req.BasicAuth(); ok {
+			if u, _ := currentConfig().Authenticate(name, password); u != nil {
+				user = u.Name
+			}
+		}
+	}
+	return allowMessage("http:"+client, user, size)
+}
+
+func remoteHost(addr string) string {
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+////////////////////
+
+// connSlot is a MQTT connection counted for the connection limits.
+type connSlot struct {
+	user string
+	ip   string
+}
+
+var connCounts = struct {
+	mutex sync.Mutex
+	users map[string]int
+	ips   map[string]int
+}{
+	users: make(map[string]int),
+	ips:   make(map[string]int),
+}
+
+// acquireConnection counts a new connection of the user from the ip.
+// It returns mqtt.QuotaExceeded if the user or the ip has too many connections.
+// An empty user (anonymous clients) or ip (in-process clients) is neither
+// limited nor counted, so that these clients do not share one count.
+func acquireConnection(user, ip string) (*connSlot, error) {
+
+	limits := &currentConfig().Limits
+
+	connCounts.mutex.Lock()
+	defer connCounts.mutex.Unlock()
+
+	if limits.MaxUserConnections != 0 && user != "" && connCounts.users[user] >= limits.MaxUserConnections {
+		limited.With("user_connections").Inc()
+		return nil, mqtt.QuotaExceeded
+	}
+	if limits.MaxIPConnections != 0 && ip != "" && connCounts.ips[ip] >= limits.MaxIPConnections {
+		limited.With("ip_connections").Inc()
+		return nil, mqtt.QuotaExceeded
+	}
+	if user != "" {
+		connCounts.users[user]++
+	}
+	if ip != "" {
+		connCounts.ips[ip]++
+	}
+	return &connSlot{user, ip}, nil
+}
+
+func (slot *connSlot) release() {
+
+	connCounts.mutex.Lock()
+	defer connCounts.mutex.Unlock()
+
+	if slot.user != "" {
+		if connCounts.users[slot.user]--; connCounts.users[slot.user] <= 0 {
+			delete(connCounts.users, slot.user)
+		}
+	}
+	if slot.ip != "" {
+		if connCounts.ips[slot.ip]--; connCounts.ips[slot.ip] <= 0 {
+			delete(connCounts.ips, slot.ip)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Package logging provides the structured, levelled loggers of the server.
+//
+// Every subsystem (http, mqtt, ws, api, ...) has its own logger with its own
+// level, so that e.g. MQTT can be debugged without flooding the log with HTTP
+// requests. Credentials and tokens are redacted from all records.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	mutex    sync.Mutex
+	base     atomic.Value // output
+	levels   = make(map[string]*slog.LevelVar)
+	loggers  = make(map[string]*slog.Logger)
+	defLevel = new(slog.LevelVar) // subsystems without own level
+)
+
+// output wraps the handler of the configured format,
+// atomic.Value requires the same type for every Store().
+type output struct {
+	slog.Handler
+}
+
+func init() {
+	base.Store(output{newHandler(os.Stderr, "logfmt")})
+}
+
+// Setup sets the output and format ("json" or "logfmt") of all loggers.
+func Setup(w io.Writer, format string) error {
+
+	if format != "json" && format != "logfmt" {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	base.Store(output{newHandler(w, format)})
+	return nil
+}
+
+func newHandler(w io.Writer, format string) slog.Handler {
+
+	opts := &slog.HandlerOptions{
+		Level:       slog.LevelDebug, // filtered per subsystem
+		ReplaceAttr: redactAttr,
+	}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// For returns the logger of a subsystem.
+func For(subsystem string) *slog.Logger {
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if logger, ok := loggers[subsystem]; ok {
+		return logger
+	}
+	logger := slog.New(&levelHandler{
+		level: level(subsystem),
+	}).With("sys", subsystem)
+	loggers[subsystem] = logger
+	return logger
+}
+
+// level returns the level of the subsystem, the mutex must be held.
+func level(subsystem string) *slog.LevelVar {
+
+	lv, ok := levels[subsystem]
+	if !ok {
+		lv = new(slog.LevelVar)
+		lv.Set(defLevel.Level())
+		levels[subsystem] = lv
+	}
+	return lv
+}
+
+// SetLevels changes the default level and the levels of individual subsystems
+// at runtime. Levels are "debug", "info", "warn" or "error".
+// Subsystems not mentioned in perSubsystem get the default level.
+func SetLevels(def string, perSubsystem map[string]string) error {
+
+	defLvl, parsed, err := parseLevels(def, perSubsystem)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	defLevel.Set(defLvl)
+	for subsystem, lv := range levels {
+		if _, ok := parsed[subsystem]; !ok {
+			lv.Set(defLvl)
+		}
+	}
+	for subsystem, lvl := range parsed {
+		level(subsystem).Set(lvl)
+	}
+	return nil
+}
+
+// CheckLevels returns the error SetLevels would return, without changing
+// any level.
+func CheckLevels(def string, perSubsystem map[string]string) error {
+
+	_, _, err := parseLevels(def, perSubsystem)
+	return err
+}
+
+func parseLevels(def string, perSubsystem map[string]string) (slog.Level, map[string]slog.Level, error) {
+
+	var defLvl slog.Level
+	if err := defLvl.UnmarshalText([]byte(def)); err != nil {
+		return 0, nil, err
+	}
+	parsed := make(map[string]slog.Level, len(perSubsystem))
+	for subsystem, l := range perSubsystem {
+		var lvl slog.Level
+		if err := lvl.UnmarshalText([]byte(l)); err != nil {
+			return 0, nil, fmt.Errorf("log level of %q: %v", subsystem, err)
+		}
+		parsed[subsystem] = lvl
+	}
+	return defLvl, parsed, nil
+}
+
+// Fatal logs the error and exits the process.
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+////////////////////
+
+// levelHandler filters records by the level of a subsystem and passes them
+// to the current output handler, so that loggers obtained before Setup()
+// write to the configured output as well.
+type levelHandler struct {
+	level *slog.LevelVar
+	with  []func(slog.Handler) slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	next := base.Load().(output).Handler
+	for _, with := range h.with {
+		next = with(next)
+	}
+	return next.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.derive(func(next slog.Handler) slog.Handler {
+		return next.WithAttrs(attrs)
+	})
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return h.derive(func(next slog.Handler) slog.Handler {
+		return next.WithGroup(name)
+	})
+}
+
+func (h *levelHandler) derive(with func(slog.Handler) slog.Handler) slog.Handler {
+	withs := make([]func(slog.Handler) slog.Handler, len(h.with), len(h.with)+1)
+	copy(withs, h.with)
+	return &levelHandler{h.level, append(withs, with)}
+}
+
+////////////////////
+
+// AccessFormat is the format of AccessLog(): "structured" (default) logs the
+// fields as attributes, "common" and "combined" produce the Apache log formats.
+var AccessFormat = "structured"
+
+// Access is a HTTP request for the access log.
+type Access struct {
+	Time      time.Time
+	Duration  time.Duration
+	Tag       string
+	Remote    string
+	User      string
+	Method    string
+	URI       string
+	Proto     string
+	Status    int
+	Size      int
+	Referer   string
+	UserAgent string
+}
+
+// AccessLog logs a HTTP request with credentials removed from the URI.
+func AccessLog(logger *slog.Logger, a *Access) {
+
+	uri := RedactURI(a.URI)
+
+	switch AccessFormat {
+	case "common", "combined":
+		user := a.User
+		if user == "" {
+			user = "-"
+		}
+		line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d",
+			a.Remote, user, a.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			a.Method, uri, a.Proto, a.Status, a.Size)
+		if AccessFormat == "combined" {
+			line += fmt.Sprintf(" %q %q", a.Referer, a.UserAgent)
+		}
+		logger.Info(line)
+	default:
+		logger.Info("request",
+			"tag", strings.TrimSpace(a.Tag),
+			"remote", a.Remote,
+			"user", a.User,
+			"method", a.Method,
+			"uri", uri,
+			"status", a.Status,
+			"size", a.Size,
+			"duration", a.Duration)
+	}
+}
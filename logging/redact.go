@@ -0,0 +1,91 @@
+package logging
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// secret tells if a field with this name holds credentials.
+func secret(name string) bool {
+
+	name = strings.ToLower(name)
+	for _, s := range []string{"password", "passwd", "secret", "token", "authorization", "cookie", "apikey", "api_key"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+
+	if a.Value.Kind() != slog.KindGroup && secret(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+// RedactURI removes credentials from the query of the URI.
+func RedactURI(uri string) string {
+
+	i := strings.IndexByte(uri, '?')
+	if i == -1 {
+		return uri
+	}
+	query, err := url.ParseQuery(uri[i+1:])
+	if err != nil {
+		return uri[:i] + "?" + redacted
+	}
+	changed := false
+	for key := range query {
+		if secret(key) {
+			query[key] = []string{redacted}
+			changed = true
+		}
+	}
+	if !changed {
+		return uri
+	}
+	return uri[:i] + "?" + query.Encode()
+}
+
+// RedactJSON removes credentials from a JSON document.
+// Data that is not JSON is returned unchanged.
+func RedactJSON(data []byte) []byte {
+
+	var v interface{}
+	if json.Unmarshal(data, &v) != nil {
+		return data
+	}
+	if !redactValue(v) {
+		return data
+	}
+	redactedData, _ := json.Marshal(v)
+	return redactedData
+}
+
+func redactValue(v interface{}) (changed bool) {
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if secret(key) {
+				v[key] = redacted
+				changed = true
+			} else if redactValue(value) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if redactValue(value) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
@@ -2,61 +2,231 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"flag"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/j-forster/Waziup-API/mqtt"
+	"github.com/j-forster/Waziup-API/logging"
+	"github.com/j-forster/Waziup-API/metrics"
 	"github.com/j-forster/Waziup-API/tools"
+	"github.com/j-forster/Waziup-API/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func main() {
+var logMain = logging.For("main")
+
+var tracer = otel.Tracer("github.com/j-forster/Waziup-API")
 
-	// Remove date and time from logs
-	log.SetFlags(log.Flags() &^ (log.Ldate | log.Ltime))
+var (
+	httpRequests = metrics.NewCounterVec("http_requests_total",
+		"Number of HTTP requests by route, method and status.", "route", "method", "status")
+	httpLatency = metrics.NewHistogramVec("http_request_duration_seconds",
+		"Time to handle HTTP requests by route and method.", metrics.DefBuckets, "route", "method")
+)
+
+func init() {
+	metrics.Register(httpRequests, httpLatency)
+}
+
+func main() {
 
 	tlsCert := flag.String("crt", "", "TLS Cert File (.crt)")
 	tlsKey := flag.String("key", "", "TLS Key File (.key)")
+	grace := flag.Duration("grace", 10*time.Second, "Grace period for a clean shutdown")
+	tlsCA := flag.String("ca", "", "CA bundle (.crt) to verify client certificates")
+	tlsClientAuth := flag.String("client-auth", "optional", "Client certificates with -ca: \"optional\" or \"require\"")
+	tlsCRL := flag.String("crl", "", "Certificate Revocation List (.crl) for client certificates, reloaded on SIGHUP")
+	flag.StringVar(&configFile, "config", "", "Configuration File (.json), reloaded on SIGHUP")
+	logFormat := flag.String("log-format", "logfmt", "Log format: \"logfmt\" or \"json\"")
+	flag.StringVar(&logLevel, "log-level", "info", "Log level: \"debug\", \"info\", \"warn\" or \"error\"")
+	flag.StringVar(&logging.AccessFormat, "access-log", "structured", "HTTP access log format: \"structured\", \"common\" or \"combined\"")
+	traceExporter := flag.String("trace", "none", "Trace exporter: \"none\", \"stdout\" or \"otlp\"")
+	traceEndpoint := flag.String("trace-endpoint", "", "OTLP/HTTP endpoint URL for -trace otlp (default from OTEL_EXPORTER_OTLP_ENDPOINT)")
+	flag.StringVar(&httpAddr, "http", ":80", "HTTP listen address")
+	flag.StringVar(&httpsAddr, "https", ":443", "HTTPS listen address (with -crt and -key)")
+	flag.StringVar(&mqttAddr, "mqtt", ":1883", "MQTT listen address")
+	flag.StringVar(&mqttsAddr, "mqtts", ":8883", "MQTT with TLS listen address (with -crt and -key)")
 
 	flag.Parse()
 
 	////////////////////
 
-	if *tlsCert != "" && *tlsKey != "" {
+	if err := logging.Setup(os.Stderr, *logFormat); err != nil {
+		logging.Fatal(logMain, "invalid -log-format", "error", err)
+	}
+	switch logging.AccessFormat {
+	case "structured", "common", "combined":
+	default:
+		logging.Fatal(logMain, "invalid -access-log", "format", logging.AccessFormat)
+	}
 
-		cert, err := ioutil.ReadFile(*tlsCert)
-		if err != nil {
-			log.Println("Error reading", *tlsCert)
-			log.Fatalln(err)
-		}
+	var err error
+	stopTracing, err = tracing.Setup(context.Background(), *traceExporter, *traceEndpoint)
+	if err != nil {
+		logging.Fatal(logMain, "invalid -trace", "error", err)
+	}
 
-		key, err := ioutil.ReadFile(*tlsKey)
+	cfg := &Config{}
+	if configFile != "" {
+		cfg, err = loadConfig(configFile)
 		if err != nil {
-			log.Println("Error reading", *tlsKey)
-			log.Fatalln(err)
+			logging.Fatal(logMain, "error reading configuration", "file", configFile, "error", err)
 		}
+	}
+	if err = applyConfig(cfg); err != nil {
+		logging.Fatal(logMain, "invalid configuration", "error", err)
+	}
+
+	// the bridges and the cluster stop after the deliveries drained,
+	// before the storage is closed
+	mqttServer.OnShutdown(func() {
+		stopBridges()
+		stopCluster()
+	})
+	if err = mqttServer.Start(context.Background()); err != nil {
+		logging.Fatal(logMain, "MQTT server failed", "error", err)
+	}
+	startReplay()
 
-		pair, err := tls.X509KeyPair(cert, key)
+	////////////////////
+
+	if *tlsCert != "" && *tlsKey != "" {
+
+		certs, err = newCertReloader(*tlsCert, *tlsKey)
 		if err != nil {
-			log.Println("TLS/SSL 'X509KeyPair' Error")
-			log.Fatalln(err)
+			logging.Fatal(logMain, "error reading TLS certificate", "crt", *tlsCert, "key", *tlsKey, "error", err)
 		}
 
-		cfg := &tls.Config{Certificates: []tls.Certificate{pair}}
+		cfg := &tls.Config{GetCertificate: certs.GetCertificate}
+
+		if *tlsCA != "" {
+			clientCerts, err = newClientAuth(*tlsClientAuth, *tlsCA, *tlsCRL)
+			if err != nil {
+				logging.Fatal(logMain, "error reading client CA", "ca", *tlsCA, "crl", *tlsCRL, "error", err)
+			}
+			clientCerts.Apply(cfg)
+		}
 
+		configureListener("https", httpsAddr)
+		configureListener("mqtts", mqttsAddr)
 		go ListenAndServeHTTPS(cfg)
-		go ListenAndServeMQTTTLS(cfg)
+		ListenAndServeMQTTTLS(cfg)
 	}
 
 	////////////////////
 
-	log.Println("WaziHub API Server")
-	log.Println("--------------------")
+	logMain.Info("WaziHub API Server")
+
+	configureListener("mqtt", mqttAddr)
+	configureListener("http", httpAddr)
+	ListenAndServerMQTT()
+	go ListenAndServeHTTP()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			logMain.Info("shutting down", "signal", s.String())
+			break
+		}
+		if err := reload(); err != nil {
+			logMain.Error("reload failed", "error", err)
+		} else {
+			logMain.Info("configuration reloaded")
+		}
+	}
+
+	go func() {
+		// a second signal terminates immediately
+		<-sig
+		logging.Fatal(logMain, "forced shutdown")
+	}()
+
+	if err := shutdown(*grace); err != nil {
+		logging.Fatal(logMain, "shutdown incomplete", "error", err)
+	}
+	logMain.Info("bye")
+}
+
+var stopTracing func(context.Context) error
+
+var certs *certReloader
+var clientCerts *clientAuth
+
+// reload reads the TLS certificates and the configuration file again.
+// Existing connections are kept, new settings apply to what happens next.
+func reload() error {
 
-	go ListenAndServerMQTT()
-	ListenAndServeHTTP()
+	if certs != nil {
+		if err := certs.Reload(); err != nil {
+			return err
+		}
+	}
+	if clientCerts != nil {
+		if err := clientCerts.Reload(); err != nil {
+			return err
+		}
+	}
+	if configFile != "" {
+		cfg, err := loadConfig(configFile)
+		if err != nil {
+			return err
+		}
+		return applyConfig(cfg)
+	}
+	return nil
+}
+
+var closing int32
+
+func shuttingDown() bool {
+	return atomic.LoadInt32(&closing) != 0
+}
+
+// shutdown stops accepting connections, drains the HTTP servers and the
+// MQTT server and returns when everything is done or the grace period is over.
+func shutdown(grace time.Duration) error {
+
+	atomic.StoreInt32(&closing, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		shutdownHTTP(ctx)
+		close(done)
+	}()
+
+	err := mqttServer.Shutdown(ctx)
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	if stopTracing != nil {
+		stopTracing(ctx)
+	}
+
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -64,6 +234,7 @@ func main() {
 type ResponseWriter struct {
 	http.ResponseWriter
 	status int
+	size   int
 }
 
 func (resp *ResponseWriter) WriteHeader(statusCode int) {
@@ -71,12 +242,25 @@ func (resp *ResponseWriter) WriteHeader(statusCode int) {
 	resp.ResponseWriter.WriteHeader(statusCode)
 }
 
+func (resp *ResponseWriter) Write(data []byte) (int, error) {
+	n, err := resp.ResponseWriter.Write(data)
+	resp.size += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush streams (see stream.go).
+func (resp *ResponseWriter) Unwrap() http.ResponseWriter {
+	return resp.ResponseWriter
+}
+
 ////////////////////
 
 func Serve(resp http.ResponseWriter, req *http.Request) {
-	wrapper := ResponseWriter{resp, 200}
+	wrapper := ResponseWriter{resp, 200, 0}
+	start := time.Now()
+	size := 0
 
-	if req.Method == http.MethodPut || req.Method == http.MethodPost {
+	if req.Method == http.MethodPut || req.Method == http.MethodPost || req.Method == http.MethodPatch {
 
 		body, err := ioutil.ReadAll(req.Body)
 		req.Body.Close()
@@ -84,31 +268,72 @@ func Serve(resp http.ResponseWriter, req *http.Request) {
 			http.Error(resp, "400 Bad Request", http.StatusBadRequest)
 			return
 		}
-		req.Body = &tools.ClosingBuffer{bytes.NewBuffer(body)}
+		req.Body = &tools.ClosingBuffer{Buffer: bytes.NewBuffer(body)}
+		size = len(body)
 	}
 
-	router.ServeHTTP(&wrapper, req)
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := tracer.Start(ctx, "HTTP "+req.Method, trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	req = req.WithContext(ctx)
 
-	log.Printf("[%s] (%s) %d %s \"%s\"\n",
-		req.Header.Get("X-Tag"),
-		req.RemoteAddr,
-		wrapper.status,
-		req.Method,
-		req.RequestURI)
+	// CORS preflight requests are answered without routing,
+	// MQTT messages are limited by the limitInterceptor already,
+	// health probes must not fail under load
+	_, viaMQTT := mqttUser(req)
+	probe := strings.HasPrefix(req.URL.Path, "/health/")
+	preflight := handleCORS(&wrapper, req)
+	allowed := !preflight && (viaMQTT || probe || allowRequest(req, size))
+	switch {
+	case preflight:
+	case allowed:
+		serveRoute(&wrapper, req)
+	default:
+		wrapper.Header().Set("Retry-After", "1")
+		http.Error(&wrapper, "Too Many Requests: Rate limit exceeded.", http.StatusTooManyRequests)
+	}
 
-	if cbuf, ok := req.Body.(*tools.ClosingBuffer); ok {
-		log.Printf("[DEBUG] Body: %s\n", cbuf.Bytes())
-		msg := mqtt.Message{
-			QoS:   0,
-			Topic: req.RequestURI[1:],
-			Buf:   cbuf.Bytes(),
-		}
+	route := routeOf(req)
+	httpRequests.With(route, req.Method, strconv.Itoa(wrapper.status)).Inc()
+	httpLatency.With(route, req.Method).Since(start)
+
+	span.SetName("HTTP " + req.Method + " " + route)
+	span.SetAttributes(
+		attribute.String("http.request.method", req.Method),
+		attribute.String("http.route", route),
+		attribute.Int("http.response.status_code", wrapper.status))
+	if wrapper.status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(wrapper.status))
+	}
 
-		// if wrapper.status >= 200 && wrapper.status < 300 {
-		if req.Method == http.MethodPut || req.Method == http.MethodPost {
-			mqttServer.Publish(nil, &msg)
+	user, _, _ := req.BasicAuth()
+	if viaMQTT {
+		user, _ = mqttUser(req)
+	}
+	logging.AccessLog(logHTTP, &logging.Access{
+		Time:      start,
+		Duration:  time.Since(start),
+		Tag:       req.Header.Get("X-Tag"),
+		Remote:    req.RemoteAddr,
+		User:      user,
+		Method:    req.Method,
+		URI:       req.RequestURI,
+		Proto:     req.Proto,
+		Status:    wrapper.status,
+		Size:      wrapper.size,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	})
+
+	var body []byte
+	if cbuf, ok := req.Body.(*tools.ClosingBuffer); ok {
+		body = cbuf.Bytes()
+		if logHTTP.Enabled(req.Context(), slog.LevelDebug) {
+			logHTTP.Debug("request body", "uri", logging.RedactURI(req.RequestURI), "body", string(logging.RedactJSON(body)))
 		}
-		// }
+	}
+	if allowed {
+		publishRESTEvents(req, route, wrapper.status, body)
 	}
 
 }
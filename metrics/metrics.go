@@ -0,0 +1,344 @@
+// Package metrics implements counters, gauges and histograms that are
+// exposed in the Prometheus text format by Handler().
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric is anything that can be written to the exposition.
+type Metric interface {
+	Name() string
+	write(w io.Writer)
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      = make(map[string]Metric)
+)
+
+// Register adds metrics to the exposition. It panics if a name is taken.
+func Register(metrics ...Metric) {
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	for _, m := range metrics {
+		if _, ok := registry[m.Name()]; ok {
+			panic("metrics: duplicate metric " + m.Name())
+		}
+		registry[m.Name()] = m
+	}
+}
+
+// WriteTo writes all registered metrics sorted by name.
+func WriteTo(w io.Writer) {
+
+	registryMutex.Lock()
+	metrics := make([]Metric, 0, len(registry))
+	for _, m := range registry {
+		metrics = append(metrics, m)
+	}
+	registryMutex.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Name() < metrics[j].Name()
+	})
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	bw.Flush()
+}
+
+// Handler serves the metrics for Prometheus.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(resp)
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) Name() string {
+	return d.name
+}
+
+func (d *desc) writeHead(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.typ)
+}
+
+// labelString formats {a="1",b="2"}, extra is appended (used for "le").
+func (d *desc) labelString(values []string, extra ...string) string {
+
+	if len(d.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range d.labels {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l + "=" + strconv.Quote(values[i]))
+	}
+	for i := 0; i < len(extra); i += 2 {
+		if b.Len() != 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra[i] + "=" + strconv.Quote(extra[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// vec holds the children of a metric for each combination of label values.
+type vec struct {
+	desc
+	mutex    sync.Mutex
+	children map[string]interface{}
+	values   map[string][]string
+}
+
+func newVec(name, help, typ string, labels []string) vec {
+	return vec{
+		desc:     desc{name, help, typ, labels},
+		children: make(map[string]interface{}),
+		values:   make(map[string][]string),
+	}
+}
+
+func (v *vec) child(values []string, create func() interface{}) interface{} {
+
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	c, ok := v.children[key]
+	if !ok {
+		c = create()
+		v.children[key] = c
+		v.values[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+func (v *vec) each(f func(values []string, c interface{})) {
+
+	v.mutex.Lock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	v.mutex.Unlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.mutex.Lock()
+		c, values := v.children[key], v.values[key]
+		v.mutex.Unlock()
+		f(values, c)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// value is a float64 that can be changed concurrently.
+type value struct {
+	mutex sync.Mutex
+	v     float64
+}
+
+func (v *value) Add(delta float64) {
+	v.mutex.Lock()
+	v.v += delta
+	v.mutex.Unlock()
+}
+
+func (v *value) Get() float64 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.v
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	value
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	value
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Set(f float64) {
+	g.mutex.Lock()
+	g.v = f
+	g.mutex.Unlock()
+}
+
+////////////////////
+
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, "counter", labels)}
+}
+
+// With returns the counter for the label values, in the order of the labels.
+func (cv *CounterVec) With(values ...string) *Counter {
+	return cv.child(values, func() interface{} { return new(Counter) }).(*Counter)
+}
+
+func (cv *CounterVec) write(w io.Writer) {
+	cv.writeHead(w)
+	cv.each(func(values []string, c interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", cv.name, cv.labelString(values), formatFloat(c.(*Counter).Get()))
+	})
+}
+
+type GaugeVec struct {
+	vec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, "gauge", labels)}
+}
+
+// With returns the gauge for the label values, in the order of the labels.
+func (gv *GaugeVec) With(values ...string) *Gauge {
+	return gv.child(values, func() interface{} { return new(Gauge) }).(*Gauge)
+}
+
+func (gv *GaugeVec) write(w io.Writer) {
+	gv.writeHead(w)
+	gv.each(func(values []string, g interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", gv.name, gv.labelString(values), formatFloat(g.(*Gauge).Get()))
+	})
+}
+
+////////////////////
+
+// GaugeFunc is a gauge whose values are collected when the metrics are scraped.
+// The function calls set once per combination of label values.
+type GaugeFunc struct {
+	desc
+	collect func(set func(v float64, values ...string))
+}
+
+func NewGaugeFunc(name, help string, labels []string, collect func(set func(v float64, values ...string))) *GaugeFunc {
+	return &GaugeFunc{desc{name, help, "gauge", labels}, collect}
+}
+
+func (gf *GaugeFunc) write(w io.Writer) {
+	gf.writeHead(w)
+	gf.collect(func(v float64, values ...string) {
+		fmt.Fprintf(w, "%s%s %s\n", gf.name, gf.labelString(values), formatFloat(v))
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// DefBuckets are the default histogram buckets (in seconds) for latencies.
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mutex.Lock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+	h.mutex.Unlock()
+}
+
+// Since observes the seconds elapsed since t.
+func (h *Histogram) Since(t time.Time) {
+	h.Observe(time.Since(t).Seconds())
+}
+
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{newVec(name, help, "histogram", labels), buckets}
+}
+
+// With returns the histogram for the label values, in the order of the labels.
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.child(values, func() interface{} {
+		return &Histogram{
+			buckets: hv.buckets,
+			counts:  make([]uint64, len(hv.buckets)),
+		}
+	}).(*Histogram)
+}
+
+func (hv *HistogramVec) write(w io.Writer) {
+	hv.writeHead(w)
+	hv.each(func(values []string, c interface{}) {
+		h := c.(*Histogram)
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, hv.labelString(values, "le", formatFloat(upper)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, hv.labelString(values, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name, hv.labelString(values), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, hv.labelString(values), h.count)
+	})
+}
@@ -2,71 +2,70 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/tls"
-	"log"
+	"encoding/hex"
 	"net"
 	"net/http"
-	"net/url"
+	"strings"
 
+	"github.com/j-forster/Waziup-API/logging"
 	"github.com/j-forster/Waziup-API/mqtt"
-	"github.com/j-forster/Waziup-API/tools"
 )
 
-var mqttHandler = &MQTTHandler{}
-var mqttServer = mqtt.NewServer(nil, mqttHandler)
+var logMQTT = logging.For("mqtt")
 
-func init() {
-	go mqttServer.Run()
-}
+var mqttServer = mqtt.NewServer(
+	mqtt.WithLogger(logMQTT),
+	mqtt.WithInterceptors(
+		authInterceptor{},
+		aclInterceptor{},
+		limitInterceptor{},
+		gatewayInterceptor{},
+		restInterceptor{},
+		clusterInterceptor{}),
+	mqtt.WithListenerHook(func(name string, err error) {
+		setListenerState(name, false, err)
+	}))
+
+// listen addresses, see main()
+var mqttAddr, mqttsAddr string
 
 func ListenAndServerMQTT() {
 
-	log.Println("[MQTT ] MQTT Server at \":1883\".")
-	listener, err := net.Listen("tcp", ":1883")
+	logMQTT.Info("MQTT server listening", "addr", mqttAddr)
+	listener, err := net.Listen("tcp", mqttAddr)
 	if err != nil {
-		log.Fatalln("[MQTT ] Error:\n", err)
+		setListenerState("mqtt", false, err)
+		logging.Fatal(logMQTT, "MQTT server failed", "addr", mqttAddr, "error", err)
 	}
 
-	for {
-
-		conn, err := listener.Accept()
-		if err == nil {
-
-			go mqttServer.Serve(conn)
-		} else {
-
-			log.Fatalln("[MQTT ] Error:\n", err)
-		}
-	}
+	mqttServer.AddListener("mqtt", listener)
+	setListenerState("mqtt", true, nil)
 }
 
-func ListenAndServeMQTTTLS(config *tls.Config) error {
+func ListenAndServeMQTTTLS(config *tls.Config) {
 
-	log.Println("[MQTTS] MQTT (with TLS) Server at \":8883\".")
+	logMQTT.Info("MQTT (with TLS) server listening", "addr", mqttsAddr)
 
-	listener, err := tls.Listen("tcp", ":8883", config)
+	listener, err := tls.Listen("tcp", mqttsAddr, config)
 	if err != nil {
-		log.Fatalln("[MQTTS] Error:\n", err)
+		setListenerState("mqtts", false, err)
+		logging.Fatal(logMQTT, "MQTT (with TLS) server failed", "addr", mqttsAddr, "error", err)
 	}
 
-	for {
-
-		conn, err := listener.Accept()
-		if err == nil {
-
-			go mqttServer.Serve(conn)
-		} else {
-
-			log.Fatalln("[MQTTS] Error:\n", err)
-		}
-	}
+	mqttServer.AddListener("mqtts", listener)
+	setListenerState("mqtts", true, nil)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// MQTTResponse is the response to a request that arrived over MQTT,
+// the body is kept for the reply (see mqttapi.go).
 type MQTTResponse struct {
 	status int
 	header http.Header
+	body   bytes.Buffer
 }
 
 func (resp *MQTTResponse) Header() http.Header {
@@ -74,51 +73,196 @@ func (resp *MQTTResponse) Header() http.Header {
 }
 
 func (resp *MQTTResponse) Write(data []byte) (int, error) {
-	return len(data), nil
+	return resp.body.Write(data)
 }
 
 func (resp *MQTTResponse) WriteHeader(statusCode int) {
 	resp.status = statusCode
 }
 
-type MQTTHandler struct{}
+// The MQTT server is composed of these interceptors, in this order:
+// authInterceptor finds out who the client is, aclInterceptor checks what the
+// user may do, limitInterceptor applies the Limits, gatewayInterceptor
+// tracks the gateways and device clients (see gateways.go), restInterceptor passes
+// the published messages to the REST API and clusterInterceptor routes them
+// to the other nodes of the cluster.
 
-func (h *MQTTHandler) Connect(conn *mqtt.Connection, username, password string) error {
-	log.Printf("[MQTT ] (%s) Connect: %s, %s\n", conn.ClientID, username, password)
-	return nil
+var (
+	errNotAuthorized  = mqtt.Reject(mqtt.NOT_AUTHORIZED_5, "not authorized")
+	errBadCredentials = mqtt.Reject(mqtt.BAD_USER_NAME_OR_PASSWORD, "bad user name or password")
+)
+
+// connUser returns the user the connection authenticated as, or the
+// principal of its client certificate (see devicePrincipal).
+func connUser(conn *mqtt.Connection) string {
+	if device, ok := conn.Get("device").(string); ok {
+		return devicePrincipal(device)
+	}
+	user, _ := conn.Get("user").(string)
+	return user
 }
 
-func (h *MQTTHandler) Disconnect(conn *mqtt.Connection) {
-	log.Printf("[MQTT ] (%s) Disconnect.\n", conn.ClientID)
+////////////////////
+
+// newClientID returns a random client ID for an in-process client that
+// serves a HTTP request, e.g. "stream-1f2e3d4c5b6a7980".
+func newClientID(prefix string) string {
+
+	var b [8]byte
+	rand.Read(b[:])
+	return prefix + "-" + hex.EncodeToString(b[:])
 }
 
-func (h *MQTTHandler) Publish(conn *mqtt.Connection, msg *mqtt.Message) error {
-	if conn != nil {
-		log.Printf("[MQTT ] (%s) Published \"%s\" [%d].\n", conn.ClientID, msg.Topic, len(msg.Buf))
+// mqttError writes the HTTP response for an error of an in-process client,
+// like a refused connect, subscription or publish.
+func mqttError(resp http.ResponseWriter, req *http.Request, err error) {
 
-		body := tools.ClosingBuffer{bytes.NewBuffer(msg.Buf)}
-		rurl, _ := url.Parse(msg.Topic)
-		req := http.Request{
-			Method: "PUBLISH",
-			URL:    rurl,
-			Header: http.Header{
-				"X-Tag": []string{"MQTT "},
-			},
-			Body:          &body,
-			ContentLength: int64(len(msg.Buf)),
-			RemoteAddr:    conn.ClientID,
-			RequestURI:    msg.Topic,
+	switch mqtt.ReasonCode(err) {
+	case mqtt.BAD_USER_NAME_OR_PASSWORD:
+		resp.Header().Set("WWW-Authenticate", `Basic realm="WaziHub"`)
+		http.Error(resp, "Unauthorized: Bad user name or password.", http.StatusUnauthorized)
+	case mqtt.NOT_AUTHORIZED_5:
+		if _, _, ok := req.BasicAuth(); !ok {
+			resp.Header().Set("WWW-Authenticate", `Basic realm="WaziHub"`)
+			http.Error(resp, "Unauthorized: Credentials required.", http.StatusUnauthorized)
+		} else {
+			http.Error(resp, "Forbidden: Not authorized.", http.StatusForbidden)
 		}
-		resp := MQTTResponse{
-			status: 200,
-			header: make(http.Header),
+	case mqtt.QUOTA_EXCEEDED:
+		resp.Header().Set("Retry-After", "1")
+		http.Error(resp, "Too Many Requests: "+err.Error()+".", http.StatusTooManyRequests)
+	case mqtt.SERVER_SHUTTING_DOWN:
+		http.Error(resp, "Service Unavailable: Server shutting down.", http.StatusServiceUnavailable)
+	default:
+		http.Error(resp, "Bad Request: "+err.Error()+".", http.StatusBadRequest)
+	}
+}
+
+////////////////////
+
+type authInterceptor struct {
+	mqtt.NopInterceptor
+}
+
+func (authInterceptor) OnConnect(conn *mqtt.Connection, username, password string) error {
+	logMQTT.Debug("connect", "client", conn.ClientID, "username", username)
+	if banned(conn.ClientID) {
+		logMQTT.Warn("banned client", "client", conn.ClientID)
+		return errNotAuthorized
+	}
+	if username == clusterUser {
+		node, ok := clusterAuth(conn.ClientID, password)
+		if !ok {
+			return errBadCredentials
+		}
+		conn.Set("cluster", node)
+		return nil
+	}
+	if device := clientIdentity(conn.TLS); device != "" {
+		// authenticated by its client certificate
+		logMQTT.Debug("client certificate", "client", conn.ClientID, "device", device)
+		conn.Set("device", device)
+		return nil
+	}
+	if strings.HasPrefix(username, devicePrefix) {
+		// devices authenticate with their certificate only
+		return errBadCredentials
+	}
+	if _, ok := currentConfig().Authenticate(username, password); !ok {
+		if username == "" {
+			return errNotAuthorized
 		}
-		Serve(&resp, &req)
+		return errBadCredentials
 	}
+	conn.Set("user", username)
 	return nil
 }
 
-func (h *MQTTHandler) Subscribe(conn *mqtt.Connection, topic string, qos byte) error {
-	log.Printf("[MQTT ] (%s) Subscribe \"%s\".\n", conn.ClientID, topic)
+func (authInterceptor) OnDisconnect(conn *mqtt.Connection) {
+	logMQTT.Debug("disconnect", "client", conn.ClientID)
+}
+
+////////////////////
+
+type aclInterceptor struct {
+	mqtt.NopInterceptor
+}
+
+func (aclInterceptor) OnPublish(conn *mqtt.Connection, msg *mqtt.Message) error {
+	if conn != nil && !clusterLink(conn) {
+		logMQTT.Debug("published", "client", conn.ClientID, "topic", msg.Topic, "size", len(msg.Buf))
+
+		if strings.HasPrefix(msg.Topic, clusterTopics) || !currentConfig().Allowed(connUser(conn), msg.Topic, WRITE) {
+			logMQTT.Warn("publish denied", "client", conn.ClientID, "topic", msg.Topic)
+			return errNotAuthorized
+		}
+	}
+	return nil
+}
+
+func (aclInterceptor) OnSubscribe(conn *mqtt.Connection, topic string, qos byte) error {
+	logMQTT.Debug("subscribe", "client", conn.ClientID, "topic", topic)
+	if !clusterLink(conn) && !currentConfig().Allowed(connUser(conn), topic, READ) {
+		logMQTT.Warn("subscribe denied", "client", conn.ClientID, "topic", topic)
+		return errNotAuthorized
+	}
+	return nil
+}
+
+////////////////////
+
+type limitInterceptor struct {
+	mqtt.NopInterceptor
+}
+
+func (limitInterceptor) OnConnect(conn *mqtt.Connection, username, password string) error {
+	if clusterLink(conn) {
+		return nil
+	}
+	slot, err := acquireConnection(connUser(conn), remoteHost(conn.RemoteAddr))
+	if err != nil {
+		logMQTT.Warn("too many connections", "client", conn.ClientID, "user", connUser(conn), "remote", conn.RemoteAddr)
+		return err
+	}
+	conn.Set("slot", slot)
+	conn.MaxSubscriptions = currentConfig().Limits.MaxSubscriptions
+	return nil
+}
+
+func (limitInterceptor) OnDisconnect(conn *mqtt.Connection) {
+	if slot, ok := conn.Get("slot").(*connSlot); ok {
+		slot.release()
+	}
+}
+
+func (limitInterceptor) OnPublish(conn *mqtt.Connection, msg *mqtt.Message) error {
+	if conn != nil && !clusterLink(conn) && !allowMessage("mqtt:"+conn.ClientID, connUser(conn), len(msg.Buf)) {
+		logMQTT.Debug("rate limit exceeded", "client", conn.ClientID, "topic", msg.Topic)
+		return mqtt.QuotaExceeded
+	}
+	return nil
+}
+
+////////////////////
+
+type restInterceptor struct {
+	mqtt.NopInterceptor
+}
+
+func (restInterceptor) OnPublish(conn *mqtt.Connection, msg *mqtt.Message) error {
+	if conn != nil && !clusterLink(conn) {
+		if strings.HasPrefix(msg.Topic, apiTopics) {
+			serveAPIRequest(conn, msg)
+			return mqtt.Consumed
+		}
+		// only topics with a route, the others are plain MQTT messages
+		if req := newMQTTRequest(conn, msg, "PUBLISH", "/"+msg.Topic); req != nil && publishRoute(req) {
+			resp := MQTTResponse{
+				status: 200,
+				header: make(http.Header),
+			}
+			Serve(&resp, req)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,211 @@
+package mqtt
+
+import (
+	"io"
+	"sync"
+)
+
+// maxClientQueue is the number of messages an in-process client may have
+// waiting before further QoS 0 messages are dropped, QoS 1 and 2 messages
+// are dropped at maxClientQueueQoS.
+const (
+	maxClientQueue    = 1000
+	maxClientQueueQoS = 10000
+)
+
+// Client is an in-process client of the server. It is authenticated,
+// authorized and limited by the interceptors like a remote client, but
+// messages are passed as Go values instead of packets.
+//
+// Messages are received at Messages() or by the function of the subscription.
+// They are queued, so that a slow client does not block the server: QoS 0
+// messages are dropped if the queue is full, QoS 1 and 2 messages are kept
+// up to a larger limit.
+type Client struct {
+	conn *Connection
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	handlers map[string]func(msg *Message) // by topic filter
+	queue    []delivery
+	closed   bool
+
+	messages chan *Message
+	// closed by Close()
+	done chan struct{}
+}
+
+type delivery struct {
+	msg *Message
+	fn  func(msg *Message)
+}
+
+// NewClient connects an in-process client. The username and password are
+// passed to the interceptors like the credentials of a CONNECT.
+func (svr *Server) NewClient(clientID, username, password string) (*Client, error) {
+
+	if !svr.Alive() {
+		return nil, Reject(SERVER_SHUTTING_DOWN, "server closing")
+	}
+
+	client := &Client{
+		handlers: make(map[string]func(msg *Message)),
+		messages: make(chan *Message),
+		done:     make(chan struct{}),
+	}
+	client.cond = sync.NewCond(&client.mutex)
+
+	conn := NewConnection(io.Discard, clientCloser{client}, svr)
+	conn.ClientID = clientID
+	conn.Listener = "local"
+	conn.deliver = client.enqueue
+	client.conn = conn
+
+	if err := svr.interceptConnect(conn, username, password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.connected()
+
+	go client.run()
+	return client, nil
+}
+
+// Connection returns the connection of the client, e.g. for Get() and Set().
+func (client *Client) Connection() *Connection {
+	return client.conn
+}
+
+// Messages returns the channel of messages received by subscriptions without
+// a function. It is closed when the client is closed.
+func (client *Client) Messages() <-chan *Message {
+	return client.messages
+}
+
+// Subscribe subscribes to the topic filter. The messages are passed to f,
+// or to Messages() if f is nil. f is called from a goroutine of the client.
+// An error is returned if the subscription is refused by the interceptors.
+func (client *Client) Subscribe(topic string, qos byte, f func(msg *Message)) error {
+
+	// the handler must be known before retained messages arrive
+	client.mutex.Lock()
+	old, had := client.handlers[topic]
+	client.handlers[topic] = f
+	client.mutex.Unlock()
+
+	if err := client.conn.subscribe(topic, qos); err != nil {
+		client.mutex.Lock()
+		if had {
+			client.handlers[topic] = old
+		} else {
+			delete(client.handlers, topic)
+		}
+		client.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscription of the topic filter.
+func (client *Client) Unsubscribe(topic string) error {
+
+	if err := client.conn.Unsubscribe(topic); err != nil {
+		return err
+	}
+	client.mutex.Lock()
+	delete(client.handlers, topic)
+	client.mutex.Unlock()
+	return nil
+}
+
+// Publish publishes the message. An error is returned if the message is
+// refused by the interceptors.
+func (client *Client) Publish(msg *Message) error {
+
+	return client.conn.server.publish(client.conn, msg)
+}
+
+// Close disconnects the client, queued messages are dropped.
+func (client *Client) Close() {
+
+	client.conn.Close()
+}
+
+// clientCloser is called when the connection is closed,
+// by Close() or by the server.
+type clientCloser struct {
+	client *Client
+}
+
+func (c clientCloser) Close() error {
+
+	client := c.client
+	client.mutex.Lock()
+	if client.closed {
+		client.mutex.Unlock()
+		return nil
+	}
+	client.closed = true
+	close(client.done)
+	if n := len(client.queue); n != 0 {
+		droppedMessages.With("disconnected").Add(float64(n))
+	}
+	client.queue = nil
+	client.mutex.Unlock()
+	client.cond.Broadcast()
+	return nil
+}
+
+////////////////////
+
+// enqueue is called from the server loop and must not block.
+func (client *Client) enqueue(sub *Subscription, msg *Message) {
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.closed {
+		return
+	}
+	if msg.QoS == 0 && len(client.queue) >= maxClientQueue {
+		droppedMessages.With("queue_full").Inc()
+		return
+	}
+	if len(client.queue) >= maxClientQueueQoS {
+		droppedMessages.With("queue_full").Inc()
+		client.conn.server.log.Warn("client queue full, message dropped", "client", client.conn.ClientID, "topic", msg.Topic, "qos", msg.QoS)
+		return
+	}
+	client.queue = append(client.queue, delivery{msg, client.handlers[sub.filter]})
+	client.cond.Signal()
+}
+
+func (client *Client) run() {
+
+	defer close(client.messages)
+
+	for {
+		client.mutex.Lock()
+		for len(client.queue) == 0 && !client.closed {
+			client.cond.Wait()
+		}
+		if client.closed {
+			client.mutex.Unlock()
+			return
+		}
+		d := client.queue[0]
+		client.queue[0] = delivery{}
+		client.queue = client.queue[1:]
+		client.mutex.Unlock()
+
+		if d.fn != nil {
+			d.fn(d.msg)
+		} else {
+			select {
+			case client.messages <- d.msg:
+			case <-client.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,1081 @@
+// Package client is a MQTT client (MQTT 3.1, 3.1.1 and 5) for TCP, TLS and
+// WebSocket connections. It uses the packet format of package mqtt.
+//
+//	c, err := client.New("tcp://localhost:1883", &client.Options{Reconnect: true})
+//	err = c.Connect(ctx)
+//	err = c.Subscribe(ctx, "devices/+/sensors/#", 1, func(msg *mqtt.Message) { ... })
+//	err = c.Publish(ctx, mqtt.NewMessage("devices/d1/sensors/s1/value", []byte("21.5"), 1, false))
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	mrand "math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/j-forster/Waziup-API/mqtt"
+)
+
+// errors
+var (
+	NotConnected    = errors.New("not connected")
+	ClientClosed    = errors.New("client closed")
+	ConnectionLost  = errors.New("connection lost")
+	PingTimeout     = errors.New("no response to ping")
+	TooManyInflight = errors.New("too many messages in flight")
+	UnexpectedType  = errors.New("unexpected packet type")
+)
+
+// Options of a client, the zero value is a MQTT 3.1 client with a random
+// client id that does not reconnect.
+type Options struct {
+	ClientID string
+	Username string
+	Password string
+	// Version is the protocol level: 3 (MQTT 3.1, default), 4 (3.1.1) or 5.
+	Version byte
+	// KeepAlive is the interval of pings, default 60s.
+	KeepAlive time.Duration
+	// CleanSession discards the session at the server. Otherwise the server
+	// keeps the subscriptions and messages in flight, with MQTT 5 for
+	// SessionExpiry seconds.
+	CleanSession  bool
+	SessionExpiry uint32
+	// Will is published by the server if the connection is lost.
+	Will      *mqtt.Message
+	TLSConfig *tls.Config
+	// Header is sent with the WebSocket handshake.
+	Header http.Header
+
+	// Reconnect connects again with exponential backoff when the connection
+	// is lost, and Connect() retries until it succeeds.
+	Reconnect  bool
+	MinBackoff time.Duration // default 1s
+	MaxBackoff time.Duration // default 2min
+	// ConnectTimeout limits the dial and the CONNECT/CONNACK, default 30s.
+	ConnectTimeout time.Duration
+	// MaxPacketSize is the largest packet the client receives.
+	MaxPacketSize int
+	// Store keeps the messages in flight, default in memory (see FileStore).
+	Store Store
+
+	// DefaultHandler receives the messages no subscription handles,
+	// e.g. of a persistent session before Subscribe() is called again.
+	DefaultHandler   func(msg *mqtt.Message)
+	OnConnect        func(c *Client, sessionPresent bool)
+	OnConnectionLost func(c *Client, err error)
+	// OnReconnectFailed is called when the client stops reconnecting after a
+	// lost connection, because the server refused it (see Refused).
+	OnReconnectFailed func(c *Client, err error)
+	Logger            *slog.Logger
+}
+
+// Client is a connection to a MQTT server.
+type Client struct {
+	addr string
+	opts Options
+	log  *slog.Logger
+
+	mutex    sync.Mutex
+	conn     *connection // nil while disconnected
+	mid      uint16
+	seq      uint64
+	inflight map[uint16]*token
+	received map[uint16]bool // QoS 2 messages before PUBREL
+	subs     map[string]*subscription
+	closed   bool
+	done     chan struct{}
+
+	// messages for the handlers, see dispatch()
+	cond  *sync.Cond
+	queue []delivery
+}
+
+type connection struct {
+	transport
+	reader *bufio.Reader
+	// a PINGREQ is waiting for its PINGRESP
+	ping atomic.Bool
+	// serializes the writes
+	mutex sync.Mutex
+}
+
+type subscription struct {
+	qos     byte
+	handler func(msg *mqtt.Message)
+}
+
+type delivery struct {
+	msg      *mqtt.Message
+	handlers []func(msg *mqtt.Message)
+}
+
+// token is a packet waiting for its acknowledgement.
+type token struct {
+	kind byte // PUBLISH, SUBSCRIBE or UNSUBSCRIBE
+	seq  uint64
+	// the PUBLISH packet and the packet to send again after a reconnect,
+	// the PUBLISH or the PUBREL
+	publish []byte
+	packet  []byte
+
+	done  chan struct{}
+	err   error
+	codes []byte // of the SUBACK
+}
+
+// New creates a client for the address, a URL like "tcp://host:1883",
+// "tls://host:8883" or "wss://host/mqtt". It loads the messages in flight
+// from the store but does not connect, see Connect().
+func New(addr string, opts *Options) (*Client, error) {
+
+	c := &Client{
+		addr:     addr,
+		inflight: make(map[uint16]*token),
+		received: make(map[uint16]bool),
+		subs:     make(map[string]*subscription),
+		done:     make(chan struct{}),
+	}
+	if opts != nil {
+		c.opts = *opts
+	}
+	c.cond = sync.NewCond(&c.mutex)
+
+	if c.opts.Version == 0 {
+		c.opts.Version = 3
+	}
+	if c.opts.Version < 3 || c.opts.Version > 5 {
+		return nil, errors.New("unsupported protocol version")
+	}
+	if c.opts.Password != "" && c.opts.Username == "" && c.opts.Version < 5 {
+		return nil, errors.New("password without user name")
+	}
+	if c.opts.ClientID == "" {
+		var b [8]byte
+		rand.Read(b[:])
+		c.opts.ClientID = "client-" + hex.EncodeToString(b[:])
+	}
+	if c.opts.KeepAlive == 0 {
+		c.opts.KeepAlive = 60 * time.Second
+	}
+	if c.opts.MinBackoff == 0 {
+		c.opts.MinBackoff = time.Second
+	}
+	if c.opts.MaxBackoff == 0 {
+		c.opts.MaxBackoff = 2 * time.Minute
+	}
+	if c.opts.ConnectTimeout == 0 {
+		c.opts.ConnectTimeout = 30 * time.Second
+	}
+	if c.opts.MaxPacketSize == 0 {
+		c.opts.MaxPacketSize = mqtt.MaxRemainingLength
+	}
+	if c.opts.Store == nil {
+		c.opts.Store = memoryStore{}
+	}
+	c.log = c.opts.Logger
+	if c.log == nil {
+		c.log = slog.Default()
+	}
+	c.log = c.log.With("client", c.opts.ClientID)
+
+	packets, err := c.opts.Store.Load()
+	if err != nil {
+		return nil, err
+	}
+	mids := make([]int, 0, len(packets))
+	for mid := range packets {
+		mids = append(mids, int(mid))
+	}
+	sort.Ints(mids)
+	for _, mid := range mids {
+		p := packets[uint16(mid)]
+		tok := c.newToken(mqtt.PUBLISH)
+		tok.packet = p
+		if len(p) != 0 && p[0]>>4 == mqtt.PUBLISH {
+			tok.publish = p
+		}
+		c.inflight[uint16(mid)] = tok
+	}
+
+	go c.dispatch()
+	return c, nil
+}
+
+// ClientID returns the client id, which is random if none was given.
+func (c *Client) ClientID() string {
+	return c.opts.ClientID
+}
+
+// Connected tells if the client is connected.
+func (c *Client) Connected() bool {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conn != nil
+}
+
+// Connect connects to the server. With Options.Reconnect it retries until
+// the connection succeeds, the server refuses it (see Refused) or ctx is done.
+func (c *Client) Connect(ctx context.Context) error {
+
+	if !c.opts.Reconnect {
+		return c.connect(ctx)
+	}
+	return c.retry(ctx)
+}
+
+func (c *Client) retry(ctx context.Context) error {
+
+	backoff := c.opts.MinBackoff
+	for {
+		err := c.connect(ctx)
+		if err == nil || err == ClientClosed || Refused(err) {
+			return err
+		}
+		// jitter, so that many clients do not reconnect at once
+		wait := backoff/2 + time.Duration(mrand.Int63n(int64(backoff/2)+1))
+		c.log.Warn("connect failed", "addr", c.addr, "error", err, "retry", wait)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.done:
+			return ClientClosed
+		}
+		backoff *= 2
+		if backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+// Refused tells if the server refused the connection for a reason that
+// retries do not change: the protocol version, the client id or the
+// credentials. An unavailable or busy server, or exceeded quotas, are not.
+func Refused(err error) bool {
+
+	var e *mqtt.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	switch e.Code {
+	case mqtt.UNSUPPORTED_PROTOCOL_VERS, mqtt.CLIENT_ID_NOT_VALID,
+		mqtt.BAD_USER_NAME_OR_PASSWORD, mqtt.NOT_AUTHORIZED_5,
+		mqtt.MALFORMED_PACKET, mqtt.PROTOCOL_ERROR, mqtt.BANNED, mqtt.BAD_AUTHENTICATION_METHOD:
+		return true
+	}
+	return false
+}
+
+func (c *Client) connect(ctx context.Context) error {
+
+	c.mutex.Lock()
+	closed, connected := c.closed, c.conn != nil
+	c.mutex.Unlock()
+	if closed {
+		return ClientClosed
+	}
+	if connected {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.opts.ConnectTimeout)
+	defer cancel()
+
+	t, err := dial(ctx, c.addr, &c.opts)
+	if err != nil {
+		return err
+	}
+	// the handshake is canceled with the context
+	stop := context.AfterFunc(ctx, func() { t.Close() })
+	defer stop()
+
+	p, err := c.connectPacket()
+	if err != nil {
+		t.Close()
+		return err
+	}
+	if _, err := t.Write(p); err != nil {
+		t.Close()
+		return err
+	}
+
+	conn := &connection{transport: t, reader: bufio.NewReader(t)}
+	var fh mqtt.FixedHeader
+	buf, err := c.readPacket(conn, &fh)
+	if err == nil && (fh.MType != mqtt.CONNACK || len(buf) < 2) {
+		err = UnexpectedType
+	}
+	if err != nil {
+		t.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if code := buf[1]; code != mqtt.ACCEPTED {
+		t.Close()
+		return c.connackError(code)
+	}
+	sessionPresent := c.opts.Version >= 4 && buf[0]&0x01 != 0
+	if !stop() {
+		return ctx.Err()
+	}
+
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		t.Close()
+		return ClientClosed
+	}
+	c.conn = conn
+	if !sessionPresent {
+		c.received = make(map[uint16]bool)
+	}
+	resend := c.resendPackets(sessionPresent)
+	var filters []string
+	var qos []byte
+	if !sessionPresent {
+		for filter, sub := range c.subs {
+			filters = append(filters, filter)
+			qos = append(qos, sub.qos)
+		}
+	}
+	c.mutex.Unlock()
+
+	c.log.Info("connected", "addr", c.addr, "version", c.opts.Version, "session_present", sessionPresent)
+
+	go c.read(conn)
+	go c.keepAlive(conn)
+
+	if len(filters) != 0 {
+		c.resubscribe(conn, filters, qos)
+	}
+	for _, p := range resend {
+		c.write(conn, p)
+	}
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect(c, sessionPresent)
+	}
+	return nil
+}
+
+// connackError maps the CONNACK return codes of MQTT 3 to reason codes.
+func (c *Client) connackError(code byte) error {
+
+	if c.opts.Version < 5 {
+		switch code {
+		case mqtt.UNACCEPTABLE_PROTOV:
+			code = mqtt.UNSUPPORTED_PROTOCOL_VERS
+		case mqtt.IDENTIFIER_REJ:
+			code = mqtt.CLIENT_ID_NOT_VALID
+		case mqtt.SERVER_UNAVAIL:
+			code = mqtt.SERVER_UNAVAILABLE
+		case mqtt.BAD_USER_OR_PASS:
+			code = mqtt.BAD_USER_NAME_OR_PASSWORD
+		case mqtt.NOT_AUTHORIZED:
+			code = mqtt.NOT_AUTHORIZED_5
+		default:
+			code = mqtt.UNSPECIFIED_ERROR
+		}
+	}
+	return mqtt.Reject(code, "connection refused")
+}
+
+// resendPackets returns the packets in flight in order, the mutex must be held.
+// Without session the server does not know the PUBRELs, so the PUBLISH is sent.
+func (c *Client) resendPackets(sessionPresent bool) [][]byte {
+
+	var toks []*token
+	for mid, tok := range c.inflight {
+		if tok.kind != mqtt.PUBLISH {
+			continue
+		}
+		if !sessionPresent && tok.packet[0]>>4 == mqtt.PUBREL {
+			if tok.publish == nil {
+				// loaded from the store, the message is lost
+				c.log.Warn("message in flight lost", "mid", mid)
+				delete(c.inflight, mid)
+				c.opts.Store.Delete(mid)
+				tok.complete(ConnectionLost)
+				continue
+			}
+			tok.packet = tok.publish
+		}
+		toks = append(toks, tok)
+	}
+	sort.Slice(toks, func(i, j int) bool { return toks[i].seq < toks[j].seq })
+
+	packets := make([][]byte, len(toks))
+	for i, tok := range toks {
+		p := tok.packet
+		if p[0]>>4 == mqtt.PUBLISH {
+			p = append([]byte(nil), p...)
+			p[0] |= 0x08 // DUP
+		}
+		packets[i] = p
+	}
+	return packets
+}
+
+// Close disconnects the client. Messages in flight are kept in the store.
+func (c *Client) Close() error {
+
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conn := c.conn
+	c.conn = nil
+	for mid, tok := range c.inflight {
+		tok.complete(ClientClosed)
+		if tok.kind != mqtt.PUBLISH {
+			delete(c.inflight, mid)
+		}
+	}
+	c.queue = nil
+	c.mutex.Unlock()
+	c.cond.Broadcast()
+
+	if conn != nil {
+		c.write(conn, []byte{mqtt.DISCONNECT << 4, 0x00})
+		return conn.Close()
+	}
+	return nil
+}
+
+////////////////////
+
+// Publish publishes the message. For QoS 1 and 2 it returns when the server
+// acknowledged the message. If ctx is done before, the message stays in flight
+// and is sent again after a reconnect.
+func (c *Client) Publish(ctx context.Context, msg *mqtt.Message) error {
+
+	if msg.Topic == "" || strings.ContainsAny(msg.Topic, "+#") {
+		return mqtt.Reject(mqtt.TOPIC_NAME_INVALID, "invalid topic name")
+	}
+	if msg.QoS > 2 {
+		return errors.New("invalid qos")
+	}
+
+	if msg.QoS == 0 {
+		p, err := c.publishPacket(msg, 0)
+		if err != nil {
+			return err
+		}
+		c.mutex.Lock()
+		conn := c.conn
+		c.mutex.Unlock()
+		if conn == nil {
+			return NotConnected
+		}
+		return c.write(conn, p)
+	}
+
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return ClientClosed
+	}
+	if c.conn == nil && !c.keepsInflight() {
+		c.mutex.Unlock()
+		return NotConnected
+	}
+	mid, err := c.nextMid()
+	if err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+	p, err := c.publishPacket(msg, mid)
+	if err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+	tok := c.newToken(mqtt.PUBLISH)
+	tok.publish, tok.packet = p, p
+	c.inflight[mid] = tok
+	conn := c.conn
+	c.mutex.Unlock()
+
+	if err := c.opts.Store.Put(mid, p); err != nil {
+		c.forget(mid, tok)
+		return err
+	}
+	if conn != nil {
+		c.write(conn, p)
+	}
+	return tok.wait(ctx)
+}
+
+// keepsInflight tells if messages in flight survive a lost connection.
+func (c *Client) keepsInflight() bool {
+	return c.opts.Reconnect || !c.opts.CleanSession
+}
+
+// Subscribe subscribes to the topic filter. The handler receives the messages
+// of the subscription (called from a goroutine of the client, one message at
+// a time). An *mqtt.Error is returned if the server refuses the subscription.
+// Subscriptions are renewed after a reconnect.
+func (c *Client) Subscribe(ctx context.Context, topic string, qos byte, handler func(msg *mqtt.Message)) error {
+
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return ClientClosed
+	}
+	if c.conn == nil {
+		c.mutex.Unlock()
+		return NotConnected
+	}
+	mid, err := c.nextMid()
+	if err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+	// the handler must be known before retained messages arrive
+	old, had := c.subs[topic]
+	c.subs[topic] = &subscription{qos, handler}
+	tok := c.newToken(mqtt.SUBSCRIBE)
+	c.inflight[mid] = tok
+	conn := c.conn
+	c.mutex.Unlock()
+
+	err = c.write(conn, c.subscribePacket(mid, []string{topic}, []byte{qos}))
+	if err == nil {
+		err = tok.wait(ctx)
+	}
+	if err == nil && tok.codes[0] >= 0x80 {
+		err = mqtt.Reject(tok.codes[0], "subscription refused")
+	}
+	if err != nil {
+		c.forget(mid, tok)
+		c.mutex.Lock()
+		if had {
+			c.subs[topic] = old
+		} else {
+			delete(c.subs, topic)
+		}
+		c.mutex.Unlock()
+	}
+	return err
+}
+
+// resubscribe renews the subscriptions after connecting without session.
+func (c *Client) resubscribe(conn *connection, filters []string, qos []byte) {
+
+	c.mutex.Lock()
+	mid, err := c.nextMid()
+	if err != nil {
+		c.mutex.Unlock()
+		c.log.Error("resubscribe failed", "error", err)
+		return
+	}
+	tok := c.newToken(mqtt.SUBSCRIBE)
+	c.inflight[mid] = tok
+	c.mutex.Unlock()
+
+	go func() {
+		<-tok.done
+		for i, code := range tok.codes {
+			if code >= 0x80 && i < len(filters) {
+				c.log.Warn("subscription refused", "topic", filters[i], "code", code)
+			}
+		}
+	}()
+	c.write(conn, c.subscribePacket(mid, filters, qos))
+}
+
+// Unsubscribe removes the subscription of the topic filter.
+func (c *Client) Unsubscribe(ctx context.Context, topic string) error {
+
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return ClientClosed
+	}
+	if c.conn == nil {
+		c.mutex.Unlock()
+		return NotConnected
+	}
+	mid, err := c.nextMid()
+	if err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+	tok := c.newToken(mqtt.UNSUBSCRIBE)
+	c.inflight[mid] = tok
+	conn := c.conn
+	c.mutex.Unlock()
+
+	body := []byte{byte(mid >> 8), byte(mid)}
+	if c.opts.Version >= 5 {
+		body = mqtt.AppendProperties(body, nil)
+	}
+	body = appendString(body, topic)
+	p, _ := packet(mqtt.UNSUBSCRIBE<<4|0x02, body)
+
+	err = c.write(conn, p)
+	if err == nil {
+		err = tok.wait(ctx)
+	}
+	if err != nil {
+		c.forget(mid, tok)
+		return err
+	}
+	c.mutex.Lock()
+	delete(c.subs, topic)
+	c.mutex.Unlock()
+	return nil
+}
+
+////////////////////
+
+// nextMid returns a free message id, the mutex must be held.
+func (c *Client) nextMid() (uint16, error) {
+
+	for i := 0; i < 0xffff; i++ {
+		c.mid = c.mid%0xffff + 1 // message ids are 1..65535
+		if _, ok := c.inflight[c.mid]; !ok {
+			return c.mid, nil
+		}
+	}
+	return 0, TooManyInflight
+}
+
+// newToken creates a token, the mutex must be held.
+func (c *Client) newToken(kind byte) *token {
+
+	c.seq++
+	return &token{kind: kind, seq: c.seq, done: make(chan struct{})}
+}
+
+// forget removes a token that is not waited for any more.
+func (c *Client) forget(mid uint16, tok *token) {
+
+	c.mutex.Lock()
+	if c.inflight[mid] == tok {
+		delete(c.inflight, mid)
+		if tok.kind == mqtt.PUBLISH {
+			c.opts.Store.Delete(mid)
+		}
+	}
+	c.mutex.Unlock()
+}
+
+// complete finishes the token, the mutex of the client must be held.
+func (tok *token) complete(err error) {
+
+	select {
+	case <-tok.done:
+	default:
+		tok.err = err
+		close(tok.done)
+	}
+}
+
+func (tok *token) wait(ctx context.Context) error {
+
+	select {
+	case <-tok.done:
+		return tok.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+////////////////////
+
+func (c *Client) write(conn *connection, p []byte) error {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	_, err := conn.Write(p)
+	return err
+}
+
+func (c *Client) readPacket(conn *connection, fh *mqtt.FixedHeader) ([]byte, error) {
+
+	if err := fh.Read(conn.reader); err != nil {
+		return nil, err
+	}
+	if fh.Length > c.opts.MaxPacketSize {
+		return nil, PacketTooLarge
+	}
+	buf := make([]byte, fh.Length)
+	if _, err := io.ReadFull(conn.reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (c *Client) read(conn *connection) {
+
+	for {
+		var fh mqtt.FixedHeader
+		buf, err := c.readPacket(conn, &fh)
+		if err == nil {
+			err = c.handle(conn, &fh, buf)
+		}
+		if err != nil {
+			c.lost(conn, err)
+			return
+		}
+	}
+}
+
+// lost is called when the connection failed.
+func (c *Client) lost(conn *connection, err error) {
+
+	conn.Close()
+
+	c.mutex.Lock()
+	if c.conn != conn {
+		// closed by Close()
+		c.mutex.Unlock()
+		return
+	}
+	c.conn = nil
+	for mid, tok := range c.inflight {
+		if tok.kind == mqtt.PUBLISH && c.keepsInflight() {
+			continue
+		}
+		delete(c.inflight, mid)
+		if tok.kind == mqtt.PUBLISH {
+			c.opts.Store.Delete(mid)
+		}
+		tok.complete(ConnectionLost)
+	}
+	c.mutex.Unlock()
+
+	c.log.Warn("connection lost", "addr", c.addr, "error", err)
+	if c.opts.OnConnectionLost != nil {
+		c.opts.OnConnectionLost(c, err)
+	}
+	if c.opts.Reconnect {
+		go c.reconnect()
+	}
+}
+
+// reconnect connects again after a lost connection.
+func (c *Client) reconnect() {
+
+	err := c.retry(context.Background())
+	if err == nil || err == ClientClosed {
+		return
+	}
+	c.log.Error("reconnect failed, giving up", "addr", c.addr, "error", err)
+	if c.opts.OnReconnectFailed != nil {
+		c.opts.OnReconnectFailed(c, err)
+	}
+}
+
+func (c *Client) keepAlive(conn *connection) {
+
+	ticker := time.NewTicker(c.opts.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+		c.mutex.Lock()
+		current := c.conn == conn
+		c.mutex.Unlock()
+		if !current {
+			return
+		}
+		if conn.ping.Load() {
+			c.lost(conn, PingTimeout)
+			return
+		}
+		conn.ping.Store(true)
+		c.write(conn, []byte{mqtt.PINGREQ << 4, 0x00})
+	}
+}
+
+////////////////////
+
+func (c *Client) handle(conn *connection, fh *mqtt.FixedHeader, buf []byte) error {
+
+	switch fh.MType {
+	case mqtt.PUBLISH:
+		return c.receive(conn, fh, buf)
+
+	case mqtt.PUBACK, mqtt.PUBREC, mqtt.PUBCOMP:
+		l, mid := readUint16(buf)
+		if l == 0 {
+			return IncompletePacket
+		}
+		var err error
+		if c.opts.Version >= 5 && len(buf) > 2 && buf[2] >= 0x80 {
+			err = mqtt.Reject(buf[2], "message refused")
+		}
+		c.mutex.Lock()
+		tok, ok := c.inflight[mid]
+		if !ok || tok.kind != mqtt.PUBLISH {
+			c.mutex.Unlock()
+			if fh.MType == mqtt.PUBREC {
+				// the server may still wait for it
+				c.write(conn, ack(mqtt.PUBREL<<4|0x02, mid))
+			}
+			return nil
+		}
+		if fh.MType == mqtt.PUBREC && err == nil {
+			tok.packet = ack(mqtt.PUBREL<<4|0x02, mid)
+			c.mutex.Unlock()
+			c.opts.Store.Put(mid, tok.packet)
+			return c.write(conn, tok.packet)
+		}
+		delete(c.inflight, mid)
+		tok.complete(err)
+		c.mutex.Unlock()
+		c.opts.Store.Delete(mid)
+		return nil
+
+	case mqtt.PUBREL:
+		l, mid := readUint16(buf)
+		if l == 0 {
+			return IncompletePacket
+		}
+		c.mutex.Lock()
+		delete(c.received, mid)
+		c.mutex.Unlock()
+		return c.write(conn, ack(mqtt.PUBCOMP<<4, mid))
+
+	case mqtt.SUBACK, mqtt.UNSUBACK:
+		l, mid := readUint16(buf)
+		if l == 0 {
+			return IncompletePacket
+		}
+		buf = buf[l:]
+		if c.opts.Version >= 5 {
+			l, _, err := mqtt.ReadProperties(buf)
+			if err != nil {
+				return err
+			}
+			buf = buf[l:]
+		}
+		kind := byte(mqtt.SUBSCRIBE)
+		if fh.MType == mqtt.UNSUBACK {
+			kind = mqtt.UNSUBSCRIBE
+		}
+		c.mutex.Lock()
+		if tok, ok := c.inflight[mid]; ok && tok.kind == kind {
+			delete(c.inflight, mid)
+			tok.codes = buf
+			if kind == mqtt.SUBSCRIBE && len(buf) == 0 {
+				tok.complete(IncompletePacket)
+			} else {
+				tok.complete(nil)
+			}
+		}
+		c.mutex.Unlock()
+		return nil
+
+	case mqtt.PINGRESP:
+		conn.ping.Store(false)
+		return nil
+
+	case mqtt.DISCONNECT:
+		code := byte(mqtt.NORMAL_DISCONNECTION)
+		if len(buf) != 0 {
+			code = buf[0]
+		}
+		return mqtt.Reject(code, "disconnected by the server")
+	}
+	return UnexpectedType
+}
+
+// receive handles a PUBLISH of the server.
+func (c *Client) receive(conn *connection, fh *mqtt.FixedHeader, buf []byte) error {
+
+	l, topic := readString(buf)
+	if l == 0 {
+		return IncompletePacket
+	}
+	buf = buf[l:]
+	var mid uint16
+	if fh.QoS != 0 {
+		if l, mid = readUint16(buf); l == 0 {
+			return IncompletePacket
+		}
+		buf = buf[l:]
+	}
+	msg := mqtt.NewMessage(topic, nil, fh.QoS, fh.Retain)
+	if c.opts.Version >= 5 {
+		l, props, err := mqtt.ReadProperties(buf)
+		if err != nil {
+			return err
+		}
+		buf = buf[l:]
+		msg.SetProperties(props)
+	}
+	msg.Buf = buf
+
+	switch fh.QoS {
+	case 0:
+		c.deliver(msg)
+		return nil
+	case 1:
+		c.deliver(msg)
+		return c.write(conn, ack(mqtt.PUBACK<<4, mid))
+	default:
+		c.mutex.Lock()
+		dup := c.received[mid]
+		c.received[mid] = true
+		c.mutex.Unlock()
+		if !dup {
+			c.deliver(msg)
+		}
+		return c.write(conn, ack(mqtt.PUBREC<<4, mid))
+	}
+}
+
+// deliver queues the message for the handlers of the subscriptions.
+func (c *Client) deliver(msg *mqtt.Message) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var handlers []func(msg *mqtt.Message)
+	for filter, sub := range c.subs {
+		if sub.handler != nil && mqtt.Match(filter, msg.Topic) {
+			handlers = append(handlers, sub.handler)
+		}
+	}
+	if len(handlers) == 0 {
+		if c.opts.DefaultHandler == nil {
+			c.log.Debug("message without handler", "topic", msg.Topic)
+			return
+		}
+		handlers = append(handlers, c.opts.DefaultHandler)
+	}
+	c.queue = append(c.queue, delivery{msg, handlers})
+	c.cond.Signal()
+}
+
+// dispatch calls the handlers, so that a slow handler does not block the
+// acknowledgements of the connection.
+func (c *Client) dispatch() {
+
+	for {
+		c.mutex.Lock()
+		for len(c.queue) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.mutex.Unlock()
+			return
+		}
+		d := c.queue[0]
+		c.queue[0] = delivery{}
+		c.queue = c.queue[1:]
+		c.mutex.Unlock()
+
+		for _, handler := range d.handlers {
+			handler(d.msg)
+		}
+	}
+}
+
+////////////////////
+
+func (c *Client) connectPacket() ([]byte, error) {
+
+	var body []byte
+	if c.opts.Version == 3 {
+		body = appendString(body, "MQIsdp")
+	} else {
+		body = appendString(body, "MQTT")
+	}
+	body = append(body, c.opts.Version)
+
+	var flags byte
+	if c.opts.CleanSession {
+		flags |= 0x02
+	}
+	if will := c.opts.Will; will != nil {
+		flags |= 0x04 | will.QoS<<3
+		if will.Retain() {
+			flags |= 0x20
+		}
+	}
+	// before MQTT 5 there is no password without user name
+	password := c.opts.Password != "" && (c.opts.Username != "" || c.opts.Version >= 5)
+	if password {
+		flags |= 0x40
+	}
+	if c.opts.Username != "" {
+		flags |= 0x80
+	}
+	keepAlive := int(c.opts.KeepAlive / time.Second)
+	body = append(body, flags, byte(keepAlive>>8), byte(keepAlive))
+	if c.opts.Version >= 5 {
+		body = mqtt.AppendProperties(body, &mqtt.Properties{SessionExpiry: c.opts.SessionExpiry})
+	}
+
+	body = appendString(body, c.opts.ClientID)
+	if will := c.opts.Will; will != nil {
+		if c.opts.Version >= 5 {
+			body = mqtt.AppendProperties(body, mqtt.MessageProperties(will))
+		}
+		body = appendString(body, will.Topic)
+		body = appendString(body, string(will.Buf))
+	}
+	if c.opts.Username != "" {
+		body = appendString(body, c.opts.Username)
+	}
+	if password {
+		body = appendString(body, c.opts.Password)
+	}
+	return packet(mqtt.CONNECT<<4, body)
+}
+
+func (c *Client) publishPacket(msg *mqtt.Message, mid uint16) ([]byte, error) {
+
+	b0 := byte(mqtt.PUBLISH<<4) | msg.QoS<<1
+	if msg.Retain() {
+		b0 |= 0x01
+	}
+	body := appendString(make([]byte, 0, 2+len(msg.Topic)+2+len(msg.Buf)), msg.Topic)
+	if msg.QoS != 0 {
+		body = append(body, byte(mid>>8), byte(mid))
+	}
+	if c.opts.Version >= 5 {
+		body = mqtt.AppendProperties(body, mqtt.MessageProperties(msg))
+	}
+	body = append(body, msg.Buf...)
+	return packet(b0, body)
+}
+
+func (c *Client) subscribePacket(mid uint16, filters []string, qos []byte) []byte {
+
+	body := []byte{byte(mid >> 8), byte(mid)}
+	if c.opts.Version >= 5 {
+		body = mqtt.AppendProperties(body, nil)
+	}
+	for i, filter := range filters {
+		body = appendString(body, filter)
+		body = append(body, qos[i])
+	}
+	p, _ := packet(mqtt.SUBSCRIBE<<4|0x02, body)
+	return p
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/j-forster/Waziup-API/mqtt"
+)
+
+func TestRefused(t *testing.T) {
+
+	tests := []struct {
+		version byte
+		code    byte
+		refused bool
+	}{
+		{4, mqtt.UNACCEPTABLE_PROTOV, true},
+		{4, mqtt.IDENTIFIER_REJ, true},
+		{4, mqtt.SERVER_UNAVAIL, false},
+		{4, mqtt.BAD_USER_OR_PASS, true},
+		{4, mqtt.NOT_AUTHORIZED, true},
+		{5, mqtt.NOT_AUTHORIZED_5, true},
+		{5, mqtt.BAD_USER_NAME_OR_PASSWORD, true},
+		{5, mqtt.SERVER_UNAVAILABLE, false},
+		{5, mqtt.SERVER_BUSY, false},
+		{5, mqtt.QUOTA_EXCEEDED, false},
+		{5, mqtt.CONNECTION_RATE_EXCEEDED, false},
+	}
+	for _, test := range tests {
+		c := &Client{opts: Options{Version: test.version}}
+		if refused := Refused(c.connackError(test.code)); refused != test.refused {
+			t.Errorf("MQTT %d CONNACK 0x%02X: refused %v, want %v", test.version, test.code, refused, test.refused)
+		}
+	}
+	if Refused(io.EOF) || Refused(ClientClosed) {
+		t.Error("errors of the connection are no refusal")
+	}
+}
+
+func TestPublishPacket(t *testing.T) {
+
+	msg := mqtt.NewMessage("a/b", []byte("21.5"), 1, true)
+	msg.ContentType = "text/plain"
+	msg.ResponseTopic = "reply/1"
+	msg.CorrelationData = []byte{1, 2}
+	msg.UserProperties = []mqtt.UserProperty{{Key: "k", Value: "v"}}
+	msg.Origin.Hops = 2
+
+	for _, version := range []byte{3, 4, 5} {
+		c := &Client{opts: Options{Version: version}}
+		p, err := c.publishPacket(msg, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fh mqtt.FixedHeader
+		if err := fh.Read(bytes.NewReader(p)); err != nil {
+			t.Fatal(err)
+		}
+		if fh.MType != mqtt.PUBLISH || fh.QoS != 1 || !fh.Retain {
+			t.Fatalf("MQTT %d: header %+v", version, fh)
+		}
+		buf := p[len(p)-fh.Length:]
+
+		l, topic := readString(buf)
+		if topic != "a/b" {
+			t.Fatalf("MQTT %d: topic %q", version, topic)
+		}
+		buf = buf[l:]
+		if l, mid := readUint16(buf); l == 0 || mid != 7 {
+			t.Fatalf("MQTT %d: mid %d", version, mid)
+		}
+		buf = buf[2:]
+		got := mqtt.NewMessage(topic, nil, fh.QoS, fh.Retain)
+		if version >= 5 {
+			l, props, err := mqtt.ReadProperties(buf)
+			if err != nil {
+				t.Fatalf("MQTT %d: %v", version, err)
+			}
+			buf = buf[l:]
+			got.SetProperties(props)
+		}
+		if string(buf) != "21.5" {
+			t.Fatalf("MQTT %d: payload %q", version, buf)
+		}
+		if version < 5 {
+			if got.ContentType != "" || got.Origin.Hops != 0 {
+				t.Errorf("MQTT %d: properties %+v", version, got)
+			}
+			continue
+		}
+		if got.ContentType != msg.ContentType || got.ResponseTopic != msg.ResponseTopic ||
+			!bytes.Equal(got.CorrelationData, msg.CorrelationData) || got.Origin.Hops != 2 ||
+			len(got.UserProperties) != 1 || got.UserProperties[0] != msg.UserProperties[0] {
+			t.Errorf("MQTT 5: properties %+v", got)
+		}
+	}
+}
+
+func TestConnectPacket(t *testing.T) {
+
+	tests := []struct {
+		version  byte
+		username string
+		password string
+		flags    byte
+	}{
+		{4, "", "", 0x00},
+		{4, "u", "", 0x80},
+		{4, "u", "p", 0xC0},
+		{4, "", "p", 0x00}, // refused by New()
+		{5, "", "p", 0x40},
+	}
+	for _, test := range tests {
+		c := &Client{opts: Options{Version: test.version, Username: test.username, Password: test.password}}
+		p, err := c.connectPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// fixed header, protocol name "MQTT", level
+		if flags := p[2+6+1]; flags != test.flags {
+			t.Errorf("MQTT %d %q %q: flags 0x%02X, want 0x%02X", test.version, test.username, test.password, flags, test.flags)
+		}
+	}
+	if _, err := New("tcp://localhost:1883", &Options{Version: 4, Password: "p"}); err == nil {
+		t.Error("MQTT 4 password without user name accepted")
+	}
+}
+
+func TestFileStore(t *testing.T) {
+
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(1, []byte{1})
+	s.Put(2, []byte{2})
+	s.Put(1, []byte{3})
+	if err := s.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(2); err != nil {
+		t.Errorf("Delete of a deleted packet: %v", err)
+	}
+
+	// a restart
+	s, _ = NewFileStore(dir)
+	packets, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 1 || !bytes.Equal(packets[1], []byte{3}) {
+		t.Errorf("Load %v", packets)
+	}
+}
+
+// refusingServer answers each CONNECT with the CONNACK return code and
+// counts the connections.
+func refusingServer(t *testing.T, code byte) (string, *atomic.Int32) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var n atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			n.Add(1)
+			var fh mqtt.FixedHeader
+			if fh.Read(conn) == nil {
+				io.CopyN(io.Discard, conn, int64(fh.Length))
+				conn.Write([]byte{mqtt.CONNACK << 4, 2, 0, code})
+			}
+			conn.Close()
+		}
+	}()
+	return "tcp://" + l.Addr().String(), &n
+}
+
+func TestConnectRetry(t *testing.T) {
+
+	tests := []struct {
+		code  byte
+		retry bool
+	}{
+		{mqtt.SERVER_UNAVAIL, true},
+		{mqtt.BAD_USER_OR_PASS, false},
+		{mqtt.NOT_AUTHORIZED, false},
+	}
+	for _, test := range tests {
+		addr, n := refusingServer(t, test.code)
+		c, err := New(addr, &Options{
+			Version:    4,
+			Reconnect:  true,
+			MinBackoff: 10 * time.Millisecond,
+			MaxBackoff: 20 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		err = c.Connect(ctx)
+		cancel()
+		c.Close()
+
+		if test.retry {
+			if !errors.Is(err, context.DeadlineExceeded) || n.Load() < 2 {
+				t.Errorf("CONNACK %d: %v after %d connections, want retries", test.code, err, n.Load())
+			}
+		} else {
+			if !Refused(err) || n.Load() != 1 {
+				t.Errorf("CONNACK %d: %v after %d connections, want no retry", test.code, err, n.Load())
+			}
+		}
+	}
+}
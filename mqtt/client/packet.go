@@ -0,0 +1,53 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/j-forster/Waziup-API/mqtt"
+)
+
+// errors
+var (
+	IncompletePacket = errors.New("incomplete packet")
+	PacketTooLarge   = errors.New("packet exceeds the maximum length")
+)
+
+// packet returns the packet with the fixed header for the body.
+func packet(b0 byte, body []byte) ([]byte, error) {
+
+	head, rest := mqtt.Head(b0, len(body), len(body))
+	if head == nil {
+		return nil, PacketTooLarge
+	}
+	copy(rest, body)
+	return head, nil
+}
+
+// ack returns a PUBACK, PUBREC, PUBREL or PUBCOMP packet.
+func ack(b0 byte, mid uint16) []byte {
+	return []byte{b0, 0x02, byte(mid >> 8), byte(mid)}
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+////////////////////
+
+func readUint16(buf []byte) (int, uint16) {
+
+	if len(buf) < 2 {
+		return 0, 0
+	}
+	return 2, uint16(buf[0])<<8 | uint16(buf[1])
+}
+
+func readString(buf []byte) (int, string) {
+
+	l, n := readUint16(buf)
+	if l == 0 || len(buf) < 2+int(n) {
+		return 0, ""
+	}
+	return 2 + int(n), string(buf[2 : 2+n])
+}
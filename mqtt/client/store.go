@@ -0,0 +1,85 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Store keeps the QoS 1 and 2 messages in flight, so that they are sent again
+// after a reconnect or a restart of the process (with a persistent session).
+// The packets are PUBLISH or PUBREL packets by message id.
+type Store interface {
+	Put(mid uint16, packet []byte) error
+	Delete(mid uint16) error
+	// Load returns the packets of the last run, it is called by New().
+	Load() (map[uint16][]byte, error)
+}
+
+// memoryStore is the default store, it does not survive restarts.
+type memoryStore struct{}
+
+func (memoryStore) Put(mid uint16, packet []byte) error { return nil }
+func (memoryStore) Delete(mid uint16) error             { return nil }
+func (memoryStore) Load() (map[uint16][]byte, error)    { return nil, nil }
+
+// FileStore keeps the packets in a directory, one file per message id, so
+// that a client with a persistent session sends them again after a restart.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates the directory if it does not exist.
+func NewFileStore(dir string) (*FileStore, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) file(mid uint16) string {
+	return filepath.Join(s.dir, strconv.Itoa(int(mid)))
+}
+
+// Put writes the packet to a temporary file first, so that a crash does not
+// leave a partial packet.
+func (s *FileStore) Put(mid uint16, packet []byte) error {
+
+	tmp := s.file(mid) + ".tmp"
+	if err := os.WriteFile(tmp, packet, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file(mid))
+}
+
+func (s *FileStore) Delete(mid uint16) error {
+
+	err := os.Remove(s.file(mid))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Load returns the packets in the directory, other files are ignored.
+func (s *FileStore) Load() (map[uint16][]byte, error) {
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	packets := make(map[uint16][]byte)
+	for _, entry := range entries {
+		mid, err := strconv.ParseUint(entry.Name(), 10, 16)
+		if err != nil || mid == 0 {
+			continue
+		}
+		packet, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		packets[uint16(mid)] = packet
+	}
+	return packets, nil
+}
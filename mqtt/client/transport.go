@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// transport is a connection to the server.
+type transport interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+}
+
+// dial opens a connection to the address, which is a URL with the scheme
+// tcp (or mqtt), tls (or ssl, mqtts), ws or wss.
+func dial(ctx context.Context, addr string, opts *Options) (transport, error) {
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return dialer.DialContext(ctx, "tcp", hostPort(u, "1883"))
+
+	case "tls", "ssl", "mqtts":
+		tlsDialer := tls.Dialer{NetDialer: &dialer, Config: opts.TLSConfig}
+		conn, err := tlsDialer.DialContext(ctx, "tcp", hostPort(u, "8883"))
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*tls.Conn), nil
+
+	case "ws", "wss":
+		wsDialer := websocket.Dialer{
+			NetDialContext:  dialer.DialContext,
+			TLSClientConfig: opts.TLSConfig,
+			Subprotocols:    []string{"mqtt"},
+		}
+		if opts.Version == 3 {
+			wsDialer.Subprotocols = []string{"mqttv3.1"}
+		}
+		header := opts.Header
+		if header == nil {
+			header = http.Header{}
+		}
+		ws, resp, err := wsDialer.DialContext(ctx, u.String(), header)
+		if err != nil {
+			if resp != nil {
+				return nil, fmt.Errorf("websocket: %s", resp.Status)
+			}
+			return nil, err
+		}
+		return &wsConn{Conn: ws}, nil
+	}
+	return nil, fmt.Errorf("unknown scheme %q", u.Scheme)
+}
+
+func hostPort(u *url.URL, port string) string {
+
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+////////////////////
+
+// wsConn reads the binary frames of a WebSocket as stream.
+// Every Write is sent as one frame, the client writes whole packets.
+type wsConn struct {
+	*websocket.Conn
+	reader io.Reader
+}
+
+func (ws *wsConn) Read(p []byte) (int, error) {
+
+	for {
+		if ws.reader == nil {
+			_, reader, err := ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			ws.reader = reader
+		}
+		n, err := ws.reader.Read(p)
+		if err == io.EOF {
+			ws.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (ws *wsConn) Write(p []byte) (int, error) {
+
+	if err := ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -1,9 +1,12 @@
 package mqtt
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
-	"log"
+	"sort"
+	"sync"
+	"time"
 )
 
 const (
@@ -18,7 +21,7 @@ type Publisher interface {
 }
 
 type SubscriptionHandler interface {
-	Subscribe(conn *Connection, topic string, qos byte) *Subscription
+	Subscribe(conn *Connection, topic string, qos byte) (*Subscription, error)
 	Unsubscribe(subs *Subscription)
 }
 
@@ -31,6 +34,18 @@ type Connection struct {
 
 	//	server   *Server
 	ClientID string
+	// protocol level from the CONNECT message (3 = MQTT 3.1, 4 = MQTT 3.1.1, 5 = MQTT 5)
+	Version byte
+	// maximum size of packets the client accepts (MQTT 5), 0 = unlimited
+	maxPacketSizeOut int
+	// TLS connection state, nil for unencrypted connections
+	TLS *tls.ConnectionState
+	// name of the listener that accepted the connection (for metrics)
+	Listener string
+	// address of the client, if known
+	RemoteAddr string
+	// maximum number of subscriptions, 0 = unlimited
+	MaxSubscriptions int
 
 	state int
 
@@ -41,6 +56,23 @@ type Connection struct {
 	messages map[int]*Message
 	subs     map[string]*Subscription
 	values   map[string]interface{}
+	// time of the accepted CONNECT, see ConnectedSince()
+	connectedSince time.Time
+
+	// guards state, subs, values and connectedSince,
+	// the connection might be closed by the server or the admin while it
+	// is reading
+	mutex sync.Mutex
+
+	// packets are written by the connection and the server loop
+	writeMutex sync.Mutex
+
+	// outgoing QoS 1 and 2 messages waiting for PUBACK or PUBCOMP
+	inflight      map[int]*Message
+	inflightMutex sync.Mutex
+
+	// delivers messages to in-process clients instead of writing packets
+	deliver func(sub *Subscription, msg *Message)
 }
 
 func NewConnection(w io.Writer, c io.Closer, server *Server) *Connection {
@@ -50,14 +82,21 @@ func NewConnection(w io.Writer, c io.Closer, server *Server) *Connection {
 		closer:   c,
 		server:   server,
 		messages: make(map[int]*Message),
+		inflight: make(map[int]*Message),
 		values:   make(map[string]interface{}),
 		subs:     make(map[string]*Subscription)}
 
+	if server != nil {
+		conn.MaxSubscriptions = server.maxSubscriptions
+		server.addConnection(conn)
+	}
 	return conn
 }
 
 func (conn *Connection) Get(key string) interface{} {
 
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
 	v, ok := conn.values[key]
 	if ok {
 		return v
@@ -67,11 +106,24 @@ func (conn *Connection) Get(key string) interface{} {
 
 func (conn *Connection) Set(key string, value interface{}) {
 
+	conn.mutex.Lock()
 	conn.values[key] = value
+	conn.mutex.Unlock()
+}
+
+// ConnectedSince returns the time of the accepted CONNECT,
+// zero while the client is connecting.
+func (conn *Connection) ConnectedSince() time.Time {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.connectedSince
 }
 
 func (conn *Connection) Alive() bool {
 
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
 	return conn.state != CLOSED
 }
 
@@ -80,35 +132,130 @@ func (conn *Connection) Write(data []byte) (n int, err error) {
 	return
 }
 
+// PacketWriter is implemented by writers that frame the packets, like a
+// WebSocket. The connection writes every packet with one WritePacket.
+type PacketWriter interface {
+	WritePacket(parts ...[]byte) error
+}
+
+// send writes a packet, given as fixed header and following parts.
+func (conn *Connection) send(packet ...[]byte) {
+
+	packetsSent.With(packetType(packet[0][0] >> 4)).Inc()
+	for _, data := range packet {
+		bytesSent.With().Add(float64(len(data)))
+	}
+
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	if pw, ok := conn.writer.(PacketWriter); ok {
+		pw.WritePacket(packet...)
+		return
+	}
+	for _, data := range packet {
+		conn.Write(data)
+	}
+}
+
 func (conn *Connection) Close() error {
 
-	if conn.state != CLOSED {
+	conn.mutex.Lock()
+	state := conn.state
+	subs := conn.subs
+	conn.state = CLOSED
+	conn.subs = nil
+	conn.mutex.Unlock()
+
+	if state != CLOSED {
+
+		if state == CONNECTED {
+			connectedClients.With(conn.Listener).Dec()
+		}
 
-		conn.state = CLOSED
+		conn.inflightMutex.Lock()
+		if n := len(conn.inflight); n != 0 {
+			inflightMessages.With().Add(float64(-n))
+			droppedMessages.With("disconnected").Add(float64(n))
+		}
+		conn.inflight = make(map[int]*Message)
+		conn.inflightMutex.Unlock()
 
-		for _, sub := range conn.subs {
+		for _, sub := range subs {
 			//conn.server
 			conn.server.Unsubscribe(sub)
 		}
 
-		conn.subs = nil
-
 		if conn.closer != nil {
 			conn.closer.Close()
 		}
 
-		if conn.server.handler != nil {
-			conn.server.handler.Disconnect(conn)
-		}
+		conn.server.removeConnection(conn)
+
+		conn.server.interceptDisconnect(conn)
 	}
 	return nil
 }
 
+// Disconnect closes the connection on behalf of the server.
+// MQTT 5 clients receive a DISCONNECT with the given reason code first,
+// MQTT 3.x has no server side DISCONNECT so the connection is just closed.
+func (conn *Connection) Disconnect(reason byte) {
+
+	conn.sendDisconnect(reason)
+	conn.Close()
+}
+
+// sendDisconnect sends a DISCONNECT to MQTT 5 clients.
+func (conn *Connection) sendDisconnect(reason byte) {
+
+	conn.mutex.Lock()
+	connected := conn.state == CONNECTED
+	conn.mutex.Unlock()
+
+	if conn.Version >= 5 && connected {
+		buf := make([]byte, 3)
+		buf[0] = 0xE0 // DISCONNECT
+		buf[1] = 0x01 // remaining length: 1
+		buf[2] = reason
+		conn.send(buf)
+	}
+}
+
+// maxPacketSize is the size limit of packets from the client.
+func (conn *Connection) maxPacketSize() int {
+	return conn.server.MaxPacketSize(conn.Listener)
+}
+
+// Inflight returns the number of QoS 1 and 2 messages sent to the client
+// that have not been acknowledged yet.
+func (conn *Connection) Inflight() int {
+
+	conn.inflightMutex.Lock()
+	n := len(conn.inflight)
+	conn.inflightMutex.Unlock()
+	return n
+}
+
+func (conn *Connection) acknowledge(mid int) {
+
+	conn.inflightMutex.Lock()
+	msg, ok := conn.inflight[mid]
+	if ok {
+		delete(conn.inflight, mid)
+		inflightMessages.With().Dec()
+	}
+	conn.inflightMutex.Unlock()
+
+	if ok {
+		conn.server.interceptAcknowledge(conn, msg)
+	}
+}
+
 func (conn *Connection) Fail(err error) error {
 
 	if conn.Alive() {
 
-		fmt.Println(err)
+		conn.server.log.Info("connection failed", "client", conn.ClientID, "error", err)
 		conn.Close()
 
 		if conn.Will != nil {
@@ -124,89 +271,186 @@ func (conn *Connection) Failf(format string, a ...interface{}) error {
 }
 
 // sowas wie Body() oder New() weil mal mit body und mal nur head benötigt wird..
+// Head returns a packet with the fixed header for the remaining length and
+// total bytes after the header. It returns nil if the length can not be encoded.
 func Head(b0 byte, length int, total int) ([]byte, []byte) {
 
-	if length < 0x80 {
-		buf := make([]byte, 2+total)
-		buf[0] = b0
-		buf[1] = byte(length)
-		return buf, buf[2:]
+	if length < 0 || length > MaxRemainingLength {
+		return nil, nil
 	}
 
-	if length < 0x8000 {
-		buf := make([]byte, 3+total)
-		buf[0] = b0
-		buf[1] = byte(length & 127)
-		buf[2] = byte(length >> 7)
-		return buf, buf[3:]
+	n := headerLength(length)
+	buf := make([]byte, n+total)
+	buf[0] = b0
+	for i := 1; i < n; i++ {
+		buf[i] = byte(length & 127)
+		length >>= 7
+		if i != n-1 {
+			buf[i] |= 128 // more bytes follow
+		}
 	}
+	return buf, buf[n:]
+}
 
-	if length < 0x800000 {
-		buf := make([]byte, 4+total)
-		buf[0] = b0
-		buf[1] = byte(length & 127)
-		buf[2] = byte((length >> 7) & 127)
-		buf[3] = byte(length >> 14)
-		return buf, buf[4:]
-	}
+// ConnAck accepts the connection (ACCEPTED) or refuses it with a CONNACK
+// return code of MQTT 3.1.1. MQTT 5 clients get the matching reason code.
+func (conn *Connection) ConnAck(code byte) {
 
-	if length < 0x80000000 {
-		buf := make([]byte, 5+total)
-		buf[0] = b0
-		buf[1] = byte(length & 127)
-		buf[2] = byte((length >> 7) & 127)
-		buf[3] = byte((length >> 14) & 127)
-		buf[4] = byte(length >> 21)
-		return buf, buf[5:]
+	if conn.Version >= 5 {
+		conn.connAck(reasonCodes[code])
+	} else {
+		conn.connAck(code)
 	}
+}
 
-	return nil, nil
+// refuse refuses the connection with a MQTT 5 reason code,
+// MQTT 3.x clients get the closest return code.
+func (conn *Connection) refuse(reason byte) {
+
+	if conn.Version >= 5 {
+		conn.connAck(reason)
+		return
+	}
+	switch reason {
+	case UNSUPPORTED_PROTOCOL_VERS:
+		conn.connAck(UNACCEPTABLE_PROTOV)
+	case CLIENT_ID_NOT_VALID:
+		conn.connAck(IDENTIFIER_REJ)
+	case BAD_USER_NAME_OR_PASSWORD:
+		conn.connAck(BAD_USER_OR_PASS)
+	case SERVER_UNAVAILABLE, SERVER_BUSY, SERVER_SHUTTING_DOWN, QUOTA_EXCEEDED, CONNECTION_RATE_EXCEEDED:
+		conn.connAck(SERVER_UNAVAIL)
+	default:
+		conn.connAck(NOT_AUTHORIZED)
+	}
 }
 
-func (conn *Connection) ConnAck(code byte) {
+// reasonCodes are the reason codes of the CONNACK return codes.
+var reasonCodes = [...]byte{
+	ACCEPTED:            0x00,
+	UNACCEPTABLE_PROTOV: UNSUPPORTED_PROTOCOL_VERS,
+	IDENTIFIER_REJ:      CLIENT_ID_NOT_VALID,
+	SERVER_UNAVAIL:      SERVER_UNAVAILABLE,
+	BAD_USER_OR_PASS:    BAD_USER_NAME_OR_PASSWORD,
+	NOT_AUTHORIZED:      NOT_AUTHORIZED_5,
+}
 
-	// buf, _ := WriteBegin(1)
-	buf := make([]byte, 4)
-	buf[0] = 0x20 // CONNACK
-	buf[1] = 0x02 // remaining length: 2
-	buf[3] = code
+// connAck sends the CONNACK with the code of the protocol version.
+func (conn *Connection) connAck(code byte) {
+
+	if conn.Version >= 5 {
+		var props *Properties
+		if code == ACCEPTED {
+			// the features this server does not have
+			max := conn.maxPacketSize()
+			props = &Properties{
+				MaximumPacketSize:     uint32(headerLength(max) + max),
+				NoSubscriptionIds:     true,
+				NoSharedSubscriptions: true,
+			}
+		}
+		body := AppendProperties([]byte{0x00, code}, props)
+		head, rest := Head(0x20, len(body), len(body)) // CONNACK
+		copy(rest, body)
+		conn.send(head)
+	} else {
+		// buf, _ := WriteBegin(1)
+		buf := make([]byte, 4)
+		buf[0] = 0x20 // CONNACK
+		buf[1] = 0x02 // remaining length: 2
+		buf[3] = code
+		conn.send(buf)
+	}
 
-	conn.Write(buf)
-	if code != 0 {
+	if code == ACCEPTED {
+		conn.connected()
+	} else {
 		conn.Close()
 	}
 }
 
+func (conn *Connection) connected() {
+
+	conn.mutex.Lock()
+	ok := conn.state != CLOSED
+	if ok {
+		conn.state = CONNECTED
+		conn.connectedSince = time.Now()
+		connectedClients.With(conn.Listener).Inc()
+	}
+	conn.mutex.Unlock()
+	if ok {
+		conn.server.interceptConnected(conn)
+	}
+}
+
 func (conn *Connection) Subscribe(topic string, qos byte) byte {
 
-	sub, ok := conn.subs[topic]
+	if err := conn.subscribe(topic, qos); err != nil {
+		return conn.subscribeFailure(err)
+	}
+
+	//TODO it's not qos, but sub.qos
+	// need to update the qos at the stored subscription
+	// (the client may subscribe to an already subscribed topic)
+	return qos // granted qos
+}
+
+func (conn *Connection) subscribe(topic string, qos byte) error {
+
+	conn.mutex.Lock()
+	_, ok := conn.subs[topic]
+	full := conn.MaxSubscriptions != 0 && len(conn.subs) >= conn.MaxSubscriptions
+	conn.mutex.Unlock()
 	if !ok {
+		if full {
+			conn.server.log.Warn("too many subscriptions", "client", conn.ClientID, "topic", topic)
+			return QuotaExceeded
+		}
 		//sub = new(Subscription)
 		//sub.conn = conn
 		//sub.qos = qos
 		//conn.server.Subscribe(topic, sub)
-		sub = conn.server.Subscribe(conn, topic, qos)
-
-		if sub != nil {
-
-			conn.subs[topic] = sub
+		sub, err := conn.server.Subscribe(conn, topic, qos)
+
+		if err == nil {
+
+			conn.mutex.Lock()
+			closed := conn.subs == nil
+			if !closed {
+				conn.subs[topic] = sub
+			}
+			conn.mutex.Unlock()
+			if closed {
+				// closed while subscribing
+				conn.server.Unsubscribe(sub)
+			}
 		} else {
 
-			// could not subscribe (the server is closing)
-			conn.Close()
-			return 0
+			// refused by an interceptor or the server is closing
+			conn.server.log.Debug("subscribe refused", "client", conn.ClientID, "topic", topic, "error", err)
+			return err
 		}
 	}
-
-	//TODO it's not qos, but sub.qos
-	// need to update the qos at the stored subscription
-	// (the client may subscribe to an already subscribed topic)
-	return qos // granted qos
+	return nil
 }
 
 func (conn *Connection) Publish(sub *Subscription, msg *Message) {
 
-	log.Printf("[DEBUG] Publish to (%s) at %q: [%d]", sub.conn.ClientID, msg.Topic, len(msg.Buf))
+	if conn.server.echo(conn, msg) {
+		droppedMessages.With("no_local").Inc()
+		return
+	}
+	msg, err := conn.server.interceptDeliver(conn, msg)
+	if err != nil {
+		if err != Consumed {
+			conn.server.log.Debug("delivery refused", "client", conn.ClientID, "error", err)
+			droppedMessages.With("refused").Inc()
+		}
+		return
+	}
+
+	conn.server.log.Debug("deliver", "client", sub.conn.ClientID, "topic", msg.Topic, "size", len(msg.Buf))
 
 	// qos = Min(sub.qos, msg.qos)
 	qos := sub.qos
@@ -214,37 +458,138 @@ func (conn *Connection) Publish(sub *Subscription, msg *Message) {
 		qos = msg.QoS
 	}
 
+	if conn.deliver != nil {
+		// in-process client, see Client
+		m := *msg
+		m.QoS = qos
+		conn.deliver(sub, &m)
+		if qos != 0 {
+			conn.server.interceptAcknowledge(conn, &m)
+		}
+		return
+	}
+
+	// MQTT 5 properties follow the message id
+	var props []byte
+	if conn.Version >= 5 {
+		props = AppendProperties(nil, MessageProperties(msg))
+	}
+
 	switch qos {
 	case 0:
 		l := len(msg.Topic)
-		head, vhead := Head(0x30|bool2byte(msg.retain), 2+l+len(msg.Buf), 2+l)
+		head, vhead := Head(0x30|bool2byte(msg.retain), 2+l+len(props)+len(msg.Buf), 2+l+len(props))
+		if head == nil || conn.tooLarge(len(head)+len(msg.Buf)) {
+			droppedMessages.With("too_large").Inc()
+			return
+		}
 		vhead[0] = byte(l >> 8)
 		vhead[1] = byte(l & 0xff)
 		copy(vhead[2:], msg.Topic)
-		conn.Write(head)
-		conn.Write(msg.Buf)
+		copy(vhead[2+l:], props)
+		conn.send(head, msg.Buf)
 	case 1, 2:
 		l := len(msg.Topic)
-		head, vhead := Head(0x30|(qos<<1)|bool2byte(msg.retain), 2+l+2+len(msg.Buf), 2+l+2)
+		head, vhead := Head(0x30|(qos<<1)|bool2byte(msg.retain), 2+l+2+len(props)+len(msg.Buf), 2+l+2+len(props))
+		if head == nil || conn.tooLarge(len(head)+len(msg.Buf)) {
+			droppedMessages.With("too_large").Inc()
+			return
+		}
 		vhead[0] = byte(l >> 8)
 		vhead[1] = byte(l & 0xff)
 		copy(vhead[2:], msg.Topic)
-		conn.mid++
-		vhead[2+l] = byte(conn.mid >> 8)
-		vhead[2+l+1] = byte(conn.mid & 0xff)
-		conn.Write(head)
-		conn.Write(msg.Buf)
+		copy(vhead[2+l+2:], props)
+		conn.inflightMutex.Lock()
+		mid := conn.nextMid()
+		if mid != 0 {
+			conn.inflight[mid] = msg
+			inflightMessages.With().Inc()
+		}
+		conn.inflightMutex.Unlock()
+		if mid == 0 {
+			// all message ids are in flight
+			droppedMessages.With("inflight").Inc()
+			return
+		}
+		vhead[2+l] = byte(mid >> 8)
+		vhead[2+l+1] = byte(mid & 0xff)
+		conn.send(head, msg.Buf)
+
+		//TODO retry if timeout
+	}
+}
+
+// nextMid returns the next message id that is not in flight, 0 if there is
+// none. The inflightMutex must be held.
+func (conn *Connection) nextMid() int {
+
+	for i := 0; i < 0xffff; i++ {
+		conn.mid = conn.mid%0xffff + 1 // message ids are 1..65535
+		if _, ok := conn.inflight[conn.mid]; !ok {
+			return conn.mid
+		}
+	}
+	return 0
+}
+
+// tooLarge tells if a packet exceeds the maximum packet size of the client.
+func (conn *Connection) tooLarge(size int) bool {
+	return conn.maxPacketSizeOut != 0 && size > conn.maxPacketSizeOut
+}
 
-		//TODO store message and retry if timeout
+// subscribeFailure is the SUBACK return code for a refused subscription.
+func (conn *Connection) subscribeFailure(err error) byte {
+
+	if conn.Version >= 5 {
+		return ReasonCode(err)
 	}
+	return SUBSCRIBE_FAILURE
 }
 
-func (conn *Connection) Unsubscribe(topic string) {
+func (conn *Connection) Unsubscribe(topic string) error {
+
+	if err := conn.server.interceptUnsubscribe(conn, topic); err != nil {
+		conn.server.log.Debug("unsubscribe refused", "client", conn.ClientID, "topic", topic, "error", err)
+		return err
+	}
 
+	conn.mutex.Lock()
 	sub, ok := conn.subs[topic]
+	delete(conn.subs, topic)
+	conn.mutex.Unlock()
 	if ok {
 		conn.server.Unsubscribe(sub)
 	}
+	return nil
+}
+
+// unsubscribe returns the UNSUBACK reason code of MQTT 5.
+func (conn *Connection) unsubscribe(topic string) byte {
+
+	conn.mutex.Lock()
+	_, ok := conn.subs[topic]
+	conn.mutex.Unlock()
+
+	if err := conn.Unsubscribe(topic); err != nil {
+		return ReasonCode(err)
+	}
+	if !ok {
+		return NO_SUBSCRIPTION_EXISTED
+	}
+	return 0x00 // success
+}
+
+// Subscriptions returns the topic filters the client is subscribed to.
+func (conn *Connection) Subscriptions() []string {
+
+	conn.mutex.Lock()
+	topics := make([]string, 0, len(conn.subs))
+	for topic := range conn.subs {
+		topics = append(topics, topic)
+	}
+	conn.mutex.Unlock()
+	sort.Strings(topics)
+	return topics
 }
 
 func (conn *Connection) PingResp() {
@@ -252,7 +597,7 @@ func (conn *Connection) PingResp() {
 	buf := make([]byte, 2)
 	buf[0] = 0xD0 // PINGRESP
 	buf[1] = 0x00 // remaining length: 0
-	conn.Write(buf)
+	conn.send(buf)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,192 @@
+package mqtt
+
+import (
+	"errors"
+)
+
+// Interceptor is a plugin of the server. The interceptors of a server form an
+// ordered chain (see AddInterceptor): a packet is passed to every interceptor
+// until one of them returns an error, which rejects the packet.
+// Return an *Error (see Reject) to reject with a specific reason code.
+//
+// Embed NopInterceptor to implement only some of the methods.
+type Interceptor interface {
+	// OnConnect is called for CONNECT before the CONNACK is sent.
+	OnConnect(conn *Connection, username, password string) error
+	// OnConnected is called after the CONNACK accepted the connection.
+	OnConnected(conn *Connection)
+	// OnSubscribe is called for each topic filter of a SUBSCRIBE.
+	OnSubscribe(conn *Connection, topic string, qos byte) error
+	// OnUnsubscribe is called for each topic filter of an UNSUBSCRIBE.
+	OnUnsubscribe(conn *Connection, topic string) error
+	// OnPublish is called for inbound messages, the message may be modified.
+	// conn is nil for messages published in-process. Return Consumed to
+	// take the message out of the server without refusing it.
+	OnPublish(conn *Connection, msg *Message) error
+	// OnDeliver is called for every subscriber of a message. The message is
+	// shared by all subscribers, so return a copy to modify it. It is called
+	// from the server loop and must not block. Return Consumed to skip the
+	// subscriber without counting the message as refused.
+	OnDeliver(conn *Connection, msg *Message) (*Message, error)
+	// OnAcknowledge is called when a QoS 1 or 2 delivery got acknowledged.
+	OnAcknowledge(conn *Connection, msg *Message)
+	// OnDisconnect is called when the connection is closed.
+	OnDisconnect(conn *Connection)
+	// OnSessionExpiry is called when the session of the client ends. Sessions
+	// are not kept after the connection, so this follows OnDisconnect.
+	OnSessionExpiry(conn *Connection)
+}
+
+// NopInterceptor accepts everything.
+type NopInterceptor struct{}
+
+func (NopInterceptor) OnConnect(conn *Connection, username, password string) error { return nil }
+func (NopInterceptor) OnConnected(conn *Connection)                                {}
+func (NopInterceptor) OnSubscribe(conn *Connection, topic string, qos byte) error  { return nil }
+func (NopInterceptor) OnUnsubscribe(conn *Connection, topic string) error          { return nil }
+func (NopInterceptor) OnPublish(conn *Connection, msg *Message) error              { return nil }
+func (NopInterceptor) OnDeliver(conn *Connection, msg *Message) (*Message, error) {
+	return msg, nil
+}
+func (NopInterceptor) OnAcknowledge(conn *Connection, msg *Message) {}
+func (NopInterceptor) OnDisconnect(conn *Connection)                {}
+func (NopInterceptor) OnSessionExpiry(conn *Connection)             {}
+
+// AddInterceptor appends interceptors to the chain.
+// It must be called before the server is started.
+func (svr *Server) AddInterceptor(interceptors ...Interceptor) {
+
+	svr.interceptors = append(svr.interceptors, interceptors...)
+}
+
+////////////////////
+
+// Error rejects a packet with a MQTT 5 reason code.
+type Error struct {
+	Code   byte
+	Reason string
+}
+
+func (err *Error) Error() string {
+	return err.Reason
+}
+
+// Reject returns an error with the reason code for interceptors.
+func Reject(code byte, reason string) error {
+	return &Error{code, reason}
+}
+
+// ReasonCode returns the reason code of the error,
+// UNSPECIFIED_ERROR if it is not an *Error.
+func ReasonCode(err error) byte {
+
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return UNSPECIFIED_ERROR
+}
+
+////////////////////
+
+// handlerInterceptor makes a Handler the first link of the chain.
+type handlerInterceptor struct {
+	NopInterceptor
+	handler Handler
+}
+
+func (h handlerInterceptor) OnConnect(conn *Connection, username, password string) error {
+	return h.handler.Connect(conn, username, password)
+}
+
+func (h handlerInterceptor) OnSubscribe(conn *Connection, topic string, qos byte) error {
+	return h.handler.Subscribe(conn, topic, qos)
+}
+
+func (h handlerInterceptor) OnPublish(conn *Connection, msg *Message) error {
+	return h.handler.Publish(conn, msg)
+}
+
+func (h handlerInterceptor) OnDisconnect(conn *Connection) {
+	h.handler.Disconnect(conn)
+}
+
+////////////////////
+
+func (svr *Server) interceptConnect(conn *Connection, username, password string) error {
+
+	if len(svr.interceptors) == 0 {
+		return NoHandler
+	}
+	for _, i := range svr.interceptors {
+		if err := i.OnConnect(conn, username, password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svr *Server) interceptConnected(conn *Connection) {
+
+	for _, i := range svr.interceptors {
+		i.OnConnected(conn)
+	}
+}
+
+func (svr *Server) interceptSubscribe(conn *Connection, topic string, qos byte) error {
+
+	for _, i := range svr.interceptors {
+		if err := i.OnSubscribe(conn, topic, qos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svr *Server) interceptUnsubscribe(conn *Connection, topic string) error {
+
+	for _, i := range svr.interceptors {
+		if err := i.OnUnsubscribe(conn, topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svr *Server) interceptPublish(conn *Connection, msg *Message) error {
+
+	for _, i := range svr.interceptors {
+		if err := i.OnPublish(conn, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svr *Server) interceptDeliver(conn *Connection, msg *Message) (*Message, error) {
+
+	for _, i := range svr.interceptors {
+		var err error
+		if msg, err = i.OnDeliver(conn, msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func (svr *Server) interceptAcknowledge(conn *Connection, msg *Message) {
+
+	for _, i := range svr.interceptors {
+		i.OnAcknowledge(conn, msg)
+	}
+}
+
+func (svr *Server) interceptDisconnect(conn *Connection) {
+
+	for _, i := range svr.interceptors {
+		i.OnDisconnect(conn)
+	}
+	for _, i := range svr.interceptors {
+		i.OnSessionExpiry(conn)
+	}
+}
@@ -1,9 +1,15 @@
 package mqtt
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
-	"log"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // errors
@@ -18,9 +24,26 @@ var (
 	ConnectProtocolUnexp    = errors.New("connect message protocol is not 'MQIsdp'")
 	TooLongClientID         = errors.New("connect client id is too long")
 	UnknownMessageID        = errors.New("unknown message id")
+	NoHandler               = errors.New("server has no handler")
+	ServerStarted           = errors.New("server already started")
+	// returned by interceptors if a client exceeds its limits
+	QuotaExceeded = Reject(QUOTA_EXCEEDED, "quota exceeded")
+	// returned by Publish if the client was disconnected for the message
+	// (QUOTA_EXCEEDED), it is not acknowledged
+	ClientDisconnected = errors.New("client disconnected")
+	// returned by Publish if a message passed too many bridges (a loop)
+	HopLimitExceeded = Reject(UNSPECIFIED_ERROR, "hop limit exceeded")
+	// returned by OnPublish if the interceptor took the message,
+	// it is not published but not refused either
+	Consumed = errors.New("message consumed by interceptor")
 )
 
-const maxMessageLength = 15360
+const (
+	// default maximum size of a packet (remaining length) a client may send
+	DefaultMaxPacketSize = 15360
+	// largest remaining length the MQTT encoding allows (256 MB)
+	MaxRemainingLength = 268435455
+)
 
 // CONNACK return codes
 const (
@@ -32,6 +55,36 @@ const (
 	NOT_AUTHORIZED      = 5
 )
 
+// SUBACK return code (MQTT 3.1.1)
+const SUBSCRIBE_FAILURE = 0x80
+
+// reason codes (MQTT 5)
+const (
+	NORMAL_DISCONNECTION      = 0x00
+	DISCONNECT_WITH_WILL      = 0x04
+	NO_SUBSCRIPTION_EXISTED   = 0x11
+	UNSPECIFIED_ERROR         = 0x80
+	MALFORMED_PACKET          = 0x81
+	PROTOCOL_ERROR            = 0x82
+	UNSUPPORTED_PROTOCOL_VERS = 0x84
+	CLIENT_ID_NOT_VALID       = 0x85
+	BAD_USER_NAME_OR_PASSWORD = 0x86
+	NOT_AUTHORIZED_5          = 0x87
+	SERVER_UNAVAILABLE        = 0x88
+	SERVER_BUSY               = 0x89
+	BANNED                    = 0x8A
+	SERVER_SHUTTING_DOWN      = 0x8B
+	BAD_AUTHENTICATION_METHOD = 0x8C
+	SESSION_TAKEN_OVER        = 0x8E
+	TOPIC_FILTER_INVALID      = 0x8F
+	TOPIC_NAME_INVALID        = 0x90
+	PACKET_TOO_LARGE          = 0x95
+	QUOTA_EXCEEDED            = 0x97
+	ADMINISTRATIVE_ACTION     = 0x98
+	PAYLOAD_FORMAT_INVALID    = 0x99
+	CONNECTION_RATE_EXCEEDED  = 0x9F
+)
+
 // message types
 const (
 	CONNECT     = 1
@@ -62,6 +115,38 @@ type Message struct {
 	Buf    []byte
 	QoS    byte
 	retain bool
+
+	// MQTT 5 user properties
+	UserProperties []UserProperty
+	// MQTT 5 content type (MIME type) of the payload, optional
+	ContentType string
+	// MQTT 5 request/response: the topic of the response, and data that
+	// the response repeats to match it to the request
+	ResponseTopic   string
+	CorrelationData []byte
+	// set by the server if the publisher did not set it
+	Origin Origin
+
+	// time the server received the message, see Received()
+	received time.Time
+	// see Context()
+	ctx context.Context
+}
+
+// NewMessage creates a message for Server.Publish().
+func NewMessage(topic string, payload []byte, qos byte, retain bool) *Message {
+	return &Message{Topic: topic, Buf: payload, QoS: qos, retain: retain}
+}
+
+// Retain tells if the message is retained at the topic.
+func (msg *Message) Retain() bool {
+	return msg.retain
+}
+
+// Received returns the time the server received the message,
+// zero for messages that were not published yet.
+func (msg *Message) Received() time.Time {
+	return msg.received
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -127,10 +212,6 @@ func (fh *FixedHeader) Read(reader io.Reader) error {
 
 		length += int(headBuf[0]&127) * multiplier
 
-		if length > maxMessageLength {
-			return MaxMessageLength // server maximum message size exceeded
-		}
-
 		if headBuf[0]&128 == 0 {
 			break
 		}
@@ -175,10 +256,6 @@ func (fh *FixedHeader) ReadMessage(msg []byte) (int, error) {
 
 		length += int(msg[0]&127) * multiplier
 
-		if length > maxMessageLength {
-			return read, MaxMessageLength // server maximum message size exceeded
-		}
-
 		if msg[0]&128 == 0 {
 			break
 		}
@@ -194,47 +271,18 @@ func (fh *FixedHeader) ReadMessage(msg []byte) (int, error) {
 	return read, nil
 }
 
-///////////////////////////////////////////////////////////////////////////////
-
-func (conn *Connection) ReadMessage(msg []byte) {
-
-	for len(msg) != 0 {
-
-		var fh FixedHeader
-		l, err := fh.ReadMessage(msg)
-		if err != nil {
-			conn.Fail(err)
-			return
-		}
-		msg = msg[l:]
-		if len(msg) > fh.Length {
-			conn.Fail(IncompleteMessage)
-			return
-		}
-		buf := msg[:fh.Length]
-		msg = msg[fh.Length:]
-
-		switch fh.MType {
-		case CONNECT:
-			conn.ReadConnectMessage(&fh, buf)
-		case SUBSCRIBE:
-			conn.ReadSubscribeMessage(&fh, buf)
-		case PUBLISH:
-			conn.ReadPublishMessage(&fh, buf)
-		case PUBREL:
-			conn.ReadPubrelMessage(&fh, buf)
-		case PUBREC:
-			conn.ReadPubrecMessage(&fh, buf)
-		case PUBCOMP:
-			conn.ReadPubcompMessage(&fh, buf)
-		case PINGREQ:
-			conn.PingResp()
-		case DISCONNECT:
-			conn.Close()
-		}
+// headerLength is the size of a fixed header for the remaining length.
+func headerLength(length int) int {
+	n := 2
+	for length >= 0x80 {
+		length >>= 7
+		n++
 	}
+	return n
 }
 
+///////////////////////////////////////////////////////////////////////////////
+
 // read from a reader (input stream) a new mqtt message
 func (conn *Connection) Read(reader io.Reader) {
 
@@ -243,10 +291,17 @@ func (conn *Connection) Read(reader io.Reader) {
 		conn.Fail(err)
 		return
 	}
+	if fh.Length > conn.maxPacketSize() {
+		// rejected before reading (and allocating) the payload
+		conn.sendDisconnect(PACKET_TOO_LARGE)
+		conn.Fail(MaxMessageLength)
+		return
+	}
 
-	buf := make([]byte, fh.Length)
+	packetsReceived.With(packetType(fh.MType)).Inc()
+	bytesReceived.With().Add(float64(headerLength(fh.Length) + fh.Length))
 
-	_, err := io.ReadFull(reader, buf)
+	buf, err := readPayload(reader, fh.Length)
 	if err != nil {
 		conn.Fail(IncompleteMessage)
 		return
@@ -264,8 +319,12 @@ func (conn *Connection) Read(reader io.Reader) {
 		conn.ReadConnectMessage(&fh, buf)
 	case SUBSCRIBE:
 		conn.ReadSubscribeMessage(&fh, buf)
+	case UNSUBSCRIBE:
+		conn.ReadUnsubscribeMessage(&fh, buf)
 	case PUBLISH:
 		conn.ReadPublishMessage(&fh, buf)
+	case PUBACK:
+		conn.ReadPubackMessage(&fh, buf)
 	case PUBREL:
 		conn.ReadPubrelMessage(&fh, buf)
 	case PUBREC:
@@ -275,8 +334,31 @@ func (conn *Connection) Read(reader io.Reader) {
 	case PINGREQ:
 		conn.PingResp()
 	case DISCONNECT:
-		conn.Close()
+		conn.ReadDisconnectMessage(&fh, buf)
+	}
+}
+
+// payloadChunk is the size up to which payloads are read at once.
+const payloadChunk = 64 << 10
+
+// readPayload reads the remaining length of a packet. Large payloads are read
+// in chunks so that a client can not make the server allocate the
+// whole size without sending the data.
+func readPayload(reader io.Reader, length int) ([]byte, error) {
+
+	if length <= payloadChunk {
+		buf := make([]byte, length)
+		_, err := io.ReadFull(reader, buf)
+		return buf, err
 	}
+
+	var buf bytes.Buffer
+	buf.Grow(payloadChunk)
+	n, err := buf.ReadFrom(io.LimitReader(reader, int64(length)))
+	if err == nil && n != int64(length) {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -288,7 +370,7 @@ func (conn *Connection) ReadConnectMessage(fh *FixedHeader, buf []byte) {
 		conn.Fail(ConnectMsgLacksProtocol)
 		return
 	}
-	if protocol != "MQIsdp" {
+	if protocol != "MQIsdp" && protocol != "MQTT" {
 		conn.Failf("unsupported protocol '%.12s'", protocol)
 		return
 	}
@@ -300,11 +382,14 @@ func (conn *Connection) ReadConnectMessage(fh *FixedHeader, buf []byte) {
 		conn.Fail(IncompleteMessage)
 		return
 	}
+	// MQTT 3.1, 3.1.1 or 5
 	version := buf[0]
-	if version != 0x03 {
+	if !(protocol == "MQIsdp" && version == 0x03 || protocol == "MQTT" && (version == 0x04 || version == 0x05)) {
+		// refused with the CONNACK of 3.1.1, older clients understand it
 		conn.ConnAck(UNACCEPTABLE_PROTOV)
 		return
 	}
+	conn.Version = version
 	buf = buf[1:]
 
 	//
@@ -341,6 +426,18 @@ func (conn *Connection) ReadConnectMessage(fh *FixedHeader, buf []byte) {
 
 	//
 
+	if conn.Version >= 5 {
+		l, props, err := ReadProperties(buf)
+		if err != nil {
+			conn.Fail(err)
+			return
+		}
+		conn.maxPacketSizeOut = int(props.MaximumPacketSize)
+		buf = buf[l:]
+	}
+
+	//
+
 	l, conn.ClientID = readString(buf)
 	if l == 0 {
 		conn.Fail(IncompleteMessage)
@@ -349,7 +446,7 @@ func (conn *Connection) ReadConnectMessage(fh *FixedHeader, buf []byte) {
 	if l > 128 {
 		// should be max 23, but some client implementations ignore this
 		// so we increase the size to 128
-		conn.ConnAck(IDENTIFIER_REJ)
+		conn.refuse(CLIENT_ID_NOT_VALID)
 		return
 	}
 	buf = buf[l:]
@@ -363,6 +460,16 @@ func (conn *Connection) ReadConnectMessage(fh *FixedHeader, buf []byte) {
 		will.retain = willRetain
 		will.QoS = willQoS
 
+		if conn.Version >= 5 {
+			l, props, err := ReadProperties(buf)
+			if err != nil {
+				conn.Fail(err)
+				return
+			}
+			will.SetProperties(props)
+			buf = buf[l:]
+		}
+
 		l, will.Topic = readString(buf)
 		if l == 0 {
 			conn.Fail(IncompleteMessage)
@@ -376,7 +483,7 @@ func (conn *Connection) ReadConnectMessage(fh *FixedHeader, buf []byte) {
 			return
 		}
 
-		log.Printf("[MQTT ] Will: topic:%q qos:%d %q\n", will.Topic, will.QoS, will.Buf)
+		conn.server.log.Debug("will", "client", conn.ClientID, "topic", will.Topic, "qos", will.QoS, "size", len(will.Buf))
 
 		conn.Will = &will
 		buf = buf[l:]
@@ -404,16 +511,33 @@ func (conn *Connection) ReadConnectMessage(fh *FixedHeader, buf []byte) {
 		}
 	}
 
-	if conn.server.handler != nil && conn.server.handler.Connect(conn, username, password) == nil {
+	if !conn.server.Alive() {
+		// the server is shutting down
+		conn.refuse(SERVER_SHUTTING_DOWN)
+		return
+	}
+
+	_, span := tracer.Start(context.Background(), "mqtt.connect", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("mqtt.client_id", conn.ClientID)))
+	defer span.End()
+
+	err := conn.server.interceptConnect(conn, username, password)
+	if err == nil {
 
 		conn.ConnAck(ACCEPTED)
 	} else {
 
-		if !usernameFlag {
-			conn.ConnAck(NOT_AUTHORIZED)
-		} else {
-			conn.ConnAck(BAD_USER_OR_PASS)
+		span.SetStatus(codes.Error, "connection refused")
+		conn.server.log.Debug("connection refused", "client", conn.ClientID, "error", err)
+		reason := ReasonCode(err)
+		if reason == UNSPECIFIED_ERROR {
+			if !usernameFlag {
+				reason = NOT_AUTHORIZED_5
+			} else {
+				reason = BAD_USER_NAME_OR_PASSWORD
+			}
 		}
+		conn.refuse(reason)
 	}
 }
 
@@ -428,9 +552,21 @@ func (conn *Connection) ReadSubscribeMessage(fh *FixedHeader, buf []byte) {
 	}
 	mid := int(buf[0])<<8 + int(buf[1])
 	buf = buf[2:]
+	if conn.Version >= 5 {
+		l, _, err := ReadProperties(buf)
+		if err != nil {
+			conn.Fail(err)
+			return
+		}
+		buf = buf[l:]
+	}
 	var s int
 	for i, l := 0, len(buf); i != l; s++ {
 
+		if i+2 > l {
+			conn.Fail(IncompleteMessage)
+			return
+		}
 		i += (int(buf[i]) << 8) + int(buf[i+1]) + 2 + 1
 		if i > l {
 			conn.Fail(IncompleteMessage)
@@ -438,14 +574,20 @@ func (conn *Connection) ReadSubscribeMessage(fh *FixedHeader, buf []byte) {
 		}
 	}
 
-	l := 2 + s
+	// MQTT 5: no properties
+	p := 0
+	if conn.Version >= 5 {
+		p = 1
+	}
+	l := 2 + p + s
 	head, body := Head(0x90, l, l) // SUBACK
 	body[0] = byte(mid >> 8)       // mid MSB
 	body[1] = byte(mid & 0xff)     // mid LSB
-	s = 2
+	s = 2 + p
 
 	for len(buf) != 0 {
 		l, topic := readString(buf)
+		// MQTT 5 has more subscription options in the upper bits
 		qos := buf[l] & 0x03
 		buf = buf[l+1:]
 
@@ -454,7 +596,58 @@ func (conn *Connection) ReadSubscribeMessage(fh *FixedHeader, buf []byte) {
 		s++
 	}
 
-	conn.Write(head)
+	conn.send(head)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// parse an UNSUBSCRIBE message and send UNSUBACK
+func (conn *Connection) ReadUnsubscribeMessage(fh *FixedHeader, buf []byte) {
+
+	if len(buf) < 2 {
+		conn.Fail(IncompleteMessage)
+		return
+	}
+	mid := int(buf[0])<<8 + int(buf[1])
+	buf = buf[2:]
+	if conn.Version >= 5 {
+		l, _, err := ReadProperties(buf)
+		if err != nil {
+			conn.Fail(err)
+			return
+		}
+		buf = buf[l:]
+	}
+
+	// reason codes of MQTT 5
+	var codes []byte
+	for len(buf) != 0 {
+		l, topic := readString(buf)
+		if l == 0 {
+			conn.Fail(IncompleteMessage)
+			return
+		}
+		buf = buf[l:]
+		codes = append(codes, conn.unsubscribe(topic))
+	}
+
+	if conn.Version >= 5 {
+		l := 2 + 1 + len(codes)
+		head, body := Head(0xB0, l, l) // UNSUBACK
+		body[0] = byte(mid >> 8)
+		body[1] = byte(mid & 0xff)
+		body[2] = 0x00 // no properties
+		copy(body[3:], codes)
+		conn.send(head)
+		return
+	}
+
+	head := make([]byte, 4)
+	head[0] = 0xB0 // UNSUBACK
+	head[1] = 0x02 // remaining length: 2
+	head[2] = byte(mid >> 8)
+	head[3] = byte(mid & 0xff)
+	conn.send(head)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -467,38 +660,64 @@ func (conn *Connection) ReadPublishMessage(fh *FixedHeader, buf []byte) {
 		return
 	}
 	l, topic := readString(buf)
-	if l == 0 {
+	if l == 0 || topic == "" {
+		// MQTT 5 topic aliases are not supported (the maximum is 0)
 		conn.Fail(IncompleteMessage)
 		return
 	}
 	buf = buf[l:]
 
-	if fh.QoS == 0 { // QoS 0
-
-		conn.server.Publish(conn, &Message{topic, buf, 0, fh.Retain})
-
-	} else { // QoS 1 or 2
-
+	mid := 0
+	if fh.QoS != 0 {
 		if len(buf) < 2 {
 			conn.Fail(IncompleteMessage)
 			return
 		}
-		mid := int(buf[0])<<8 + int(buf[1])
+		mid = int(buf[0])<<8 + int(buf[1])
 		buf = buf[2:]
+	}
+
+	var props *Properties
+	if conn.Version >= 5 {
+		var err error
+		l, props, err = ReadProperties(buf)
+		if err != nil {
+			conn.Fail(err)
+			return
+		}
+		buf = buf[l:]
+	}
+
+	msg := &Message{Topic: topic, Buf: buf, QoS: fh.QoS, retain: fh.Retain}
+	if props != nil {
+		msg.SetProperties(props)
+	}
+
+	if fh.QoS == 0 { // QoS 0
 
-		msg := &Message{topic, buf, fh.QoS, fh.Retain}
+		conn.server.Publish(conn, msg)
+
+	} else { // QoS 1 or 2
 
 		if fh.QoS == 1 {
 
-			conn.server.Publish(conn, msg)
+			err := conn.server.publish(conn, msg)
+			if err == ClientDisconnected {
+				return
+			}
 
 			// send PUBACK message
+			if conn.Version >= 5 && err != nil {
+				// MQTT 5 clients are told why the message was refused
+				conn.send([]byte{0x40, 0x03, byte(mid >> 8), byte(mid & 0xff), ReasonCode(err)})
+				return
+			}
 			buf := make([]byte, 4)
 			buf[0] = 0x40 // PUBACK
 			buf[1] = 0x02 // remaining length: 2
 			buf[2] = byte(mid >> 8)
 			buf[3] = byte(mid & 0xff)
-			conn.Write(buf)
+			conn.send(buf)
 		} else {
 
 			conn.messages[mid] = msg // store
@@ -509,13 +728,27 @@ func (conn *Connection) ReadPublishMessage(fh *FixedHeader, buf []byte) {
 			buf[1] = 0x02 // remaining length: 2
 			buf[2] = byte(mid >> 8)
 			buf[3] = byte(mid & 0xff)
-			conn.Write(buf)
+			conn.send(buf)
 		}
 	}
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 
+// parse a PUBACK message
+// (a response to a publish from this server to a client on qos 1)
+func (conn *Connection) ReadPubackMessage(fh *FixedHeader, buf []byte) {
+
+	if len(buf) < 2 {
+		conn.Fail(IncompleteMessage)
+		return
+	}
+	mid := int(buf[0])<<8 + int(buf[1])
+	conn.acknowledge(mid)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
 // parse a PUBREL message (a response to a PUBREC at QoS 2)
 // the message has alredy been stored at the previous PUBREC message
 func (conn *Connection) ReadPubrelMessage(fh *FixedHeader, buf []byte) {
@@ -532,16 +765,19 @@ func (conn *Connection) ReadPubrelMessage(fh *FixedHeader, buf []byte) {
 		return
 	}
 
-	conn.server.Publish(conn, msg)
+	err := conn.server.Publish(conn, msg)
 	delete(conn.messages, mid)
+	if err == ClientDisconnected {
+		return
+	}
 
-	// send PUBREC message
+	// send PUBCOMP message
 	buf = make([]byte, 4)
 	buf[0] = 0x70 // PUBCOMP
 	buf[1] = 0x02 // remaining length: 2
 	buf[2] = byte(mid >> 8)
 	buf[3] = byte(mid & 0xff)
-	conn.Write(buf)
+	conn.send(buf)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -555,6 +791,11 @@ func (conn *Connection) ReadPubrecMessage(fh *FixedHeader, buf []byte) {
 		return
 	}
 	mid := int(buf[0])<<8 + int(buf[1])
+	if conn.Version >= 5 && len(buf) > 2 && buf[2] >= 0x80 {
+		// refused by the client, there is no PUBREL
+		conn.acknowledge(mid)
+		return
+	}
 
 	// send PUBREL message
 	buf = make([]byte, 4)
@@ -562,7 +803,7 @@ func (conn *Connection) ReadPubrecMessage(fh *FixedHeader, buf []byte) {
 	buf[1] = 0x02 // remaining length: 2
 	buf[2] = byte(mid >> 8)
 	buf[3] = byte(mid & 0xff)
-	conn.Write(buf)
+	conn.send(buf)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -575,7 +816,18 @@ func (conn *Connection) ReadPubcompMessage(fh *FixedHeader, buf []byte) {
 		conn.Fail(IncompleteMessage)
 		return
 	}
-	// mid := int(buf[0])<<8 + int(buf[1])
+	mid := int(buf[0])<<8 + int(buf[1])
+	conn.acknowledge(mid)
 }
 
 //////////////////////////////////////////////////////////////////////////////
+
+// parse a DISCONNECT message, MQTT 5 clients may ask for their will
+func (conn *Connection) ReadDisconnectMessage(fh *FixedHeader, buf []byte) {
+
+	will := conn.Version >= 5 && len(buf) != 0 && buf[0] == DISCONNECT_WITH_WILL
+	conn.Close()
+	if will && conn.Will != nil {
+		conn.server.Publish(conn, conn.Will)
+	}
+}
@@ -0,0 +1,166 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHead(t *testing.T) {
+
+	tests := []struct {
+		length int
+		header int // size of the fixed header, 0 if the length can not be encoded
+	}{
+		{0, 2},
+		{127, 2},
+		{128, 3},
+		{16383, 3},
+		{16384, 4},
+		{2097151, 4},
+		{2097152, 5},
+		{MaxRemainingLength, 5},
+		{MaxRemainingLength + 1, 0},
+		{-1, 0},
+	}
+	for _, test := range tests {
+		head, _ := Head(0x30, test.length, 0) // PUBLISH
+		if test.header == 0 {
+			if head != nil {
+				t.Errorf("length %d: encoded as % X", test.length, head)
+			}
+			continue
+		}
+		if len(head) != test.header || headerLength(test.length) != test.header {
+			t.Errorf("length %d: header of %d bytes, headerLength %d, want %d", test.length, len(head), headerLength(test.length), test.header)
+			continue
+		}
+
+		var fh FixedHeader
+		if err := fh.Read(bytes.NewReader(head)); err != nil || fh.MType != PUBLISH || fh.Length != test.length {
+			t.Errorf("length %d: Read %+v, %v", test.length, fh, err)
+		}
+		fh = FixedHeader{}
+		if n, err := fh.ReadMessage(head); err != nil || n != test.header || fh.Length != test.length {
+			t.Errorf("length %d: ReadMessage %+v, %d bytes, %v", test.length, fh, n, err)
+		}
+	}
+}
+
+func TestFixedHeaderInvalid(t *testing.T) {
+
+	tests := []struct {
+		name string
+		head []byte
+		err  error
+	}{
+		{"five length bytes", []byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}, MessageLengthInvalid},
+		{"reserved type", []byte{0xF0, 0x00}, ReservedMessageType},
+		{"incomplete length", []byte{0x30, 0x80}, InclompleteHeader},
+	}
+	for _, test := range tests {
+		var fh FixedHeader
+		if _, err := fh.ReadMessage(test.head); err != test.err {
+			t.Errorf("%s: ReadMessage %v, want %v", test.name, err, test.err)
+		}
+		err := fh.Read(bytes.NewReader(test.head))
+		if test.err == InclompleteHeader {
+			// the reader reports the end of the stream
+			if err != io.EOF {
+				t.Errorf("%s: Read %v, want %v", test.name, err, io.EOF)
+			}
+		} else if err != test.err {
+			t.Errorf("%s: Read %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+
+	tests := []struct {
+		sizes    map[string]int
+		listener string
+		max      int
+	}{
+		{nil, "mqtt", DefaultMaxPacketSize},
+		{map[string]int{"ws": 100}, "mqtt", DefaultMaxPacketSize},
+		{map[string]int{"ws": 100}, "ws", 100},
+		{map[string]int{"*": 200}, "mqtt", 200},
+		{map[string]int{"*": 200, "mqtt": MaxRemainingLength}, "mqtt", MaxRemainingLength},
+		{map[string]int{"*": 200, "mqtt": 300}, "ws", 200},
+	}
+	for _, test := range tests {
+		svr := NewServer(WithMaxPacketSize(test.sizes))
+		if max := svr.MaxPacketSize(test.listener); max != test.max {
+			t.Errorf("%v: max of %q is %d, want %d", test.sizes, test.listener, max, test.max)
+		}
+	}
+}
+
+// readPacket reads a packet of the server, it returns its type and body.
+func readPacket(t *testing.T, r io.Reader) (byte, []byte) {
+
+	var fh FixedHeader
+	if err := fh.Read(r); err != nil {
+		return 0, nil
+	}
+	body := make([]byte, fh.Length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatal(err)
+	}
+	return fh.MType, body
+}
+
+func TestReadMaxPacketSize(t *testing.T) {
+
+	const max = 100
+	tests := []struct {
+		length int
+		ok     bool
+	}{
+		{max - 1, true},
+		{max, true},
+		{max + 1, false},
+	}
+	for _, test := range tests {
+		svr := NewServer(WithInterceptors(NopInterceptor{}), WithMaxPacketSize(map[string]int{"mqtt": max}))
+		if err := svr.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		client, server := net.Pipe()
+		go svr.ServeListener("mqtt", server)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+
+		connect := []byte{0x10, 16, 0, 4, 'M', 'Q', 'T', 'T', 5, 0x02, 0, 60, 0, 0, 2, 'c', '1'}
+		connect[1] = byte(len(connect) - 2)
+		client.Write(connect)
+		if mtype, body := readPacket(t, client); mtype != CONNACK || body[1] != ACCEPTED {
+			t.Fatalf("length %d: CONNACK % X", test.length, body)
+		}
+
+		// PUBLISH "t" at QoS 0 without properties, the rest is payload
+		head, rest := Head(0x30, test.length, test.length)
+		copy(rest, []byte{0, 1, 't', 0})
+		if test.ok {
+			client.Write(head)
+			client.Write([]byte{PINGREQ << 4, 0})
+			if mtype, _ := readPacket(t, client); mtype != PINGRESP {
+				t.Errorf("length %d: packet %d, want PINGRESP", test.length, mtype)
+			}
+		} else {
+			// the payload is never read
+			go client.Write(head)
+			if mtype, body := readPacket(t, client); mtype != DISCONNECT || len(body) == 0 || body[0] != PACKET_TOO_LARGE {
+				t.Errorf("length %d: packet %d % X, want DISCONNECT 0x95", test.length, mtype, body)
+			}
+			if mtype, _ := readPacket(t, client); mtype != 0 {
+				t.Errorf("length %d: packet %d after DISCONNECT", test.length, mtype)
+			}
+		}
+		client.Close()
+		svr.Close()
+	}
+}
@@ -0,0 +1,52 @@
+package mqtt
+
+import (
+	"github.com/j-forster/Waziup-API/metrics"
+)
+
+var (
+	connectedClients = metrics.NewGaugeVec("mqtt_connected_clients",
+		"Number of connected MQTT clients.", "listener")
+	packetsReceived = metrics.NewCounterVec("mqtt_packets_received_total",
+		"Number of MQTT packets received by type.", "type")
+	packetsSent = metrics.NewCounterVec("mqtt_packets_sent_total",
+		"Number of MQTT packets sent by type.", "type")
+	bytesReceived = metrics.NewCounterVec("mqtt_received_bytes_total",
+		"Number of bytes received in MQTT packets.")
+	bytesSent = metrics.NewCounterVec("mqtt_sent_bytes_total",
+		"Number of bytes sent in MQTT packets.")
+	publishLatency = metrics.NewHistogramVec("mqtt_publish_latency_seconds",
+		"Time from receiving a message to handing it to all subscribers.", metrics.DefBuckets)
+	publishQueue = metrics.NewGaugeVec("mqtt_publish_queue_length",
+		"Number of messages waiting for the server loop.")
+	inflightMessages = metrics.NewGaugeVec("mqtt_inflight_messages",
+		"Number of QoS 1 and 2 messages sent to clients and not acknowledged yet.")
+	droppedMessages = metrics.NewCounterVec("mqtt_dropped_messages_total",
+		"Number of messages dropped by reason.", "reason")
+	retainedMessages = metrics.NewGaugeVec("mqtt_retained_messages",
+		"Number of retained messages.")
+	subscriptions = metrics.NewGaugeVec("mqtt_subscriptions",
+		"Number of active subscriptions.")
+)
+
+func init() {
+	metrics.Register(
+		connectedClients,
+		packetsReceived,
+		packetsSent,
+		bytesReceived,
+		bytesSent,
+		publishLatency,
+		publishQueue,
+		inflightMessages,
+		droppedMessages,
+		retainedMessages,
+		subscriptions)
+}
+
+func packetType(mtype byte) string {
+	if int(mtype) < len(messageType) {
+		return messageType[mtype]
+	}
+	return "reserved"
+}
@@ -0,0 +1,78 @@
+package mqtt
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Option configures a Server, see NewServer().
+type Option func(svr *Server)
+
+// WithHandler adds the handler to the interceptor chain.
+func WithHandler(handler Handler) Option {
+	return func(svr *Server) {
+		svr.interceptors = append(svr.interceptors, handlerInterceptor{handler: handler})
+	}
+}
+
+// WithInterceptors adds interceptors to the chain, see AddInterceptor().
+func WithInterceptors(interceptors ...Interceptor) Option {
+	return func(svr *Server) {
+		svr.interceptors = append(svr.interceptors, interceptors...)
+	}
+}
+
+// WithLogger sets the logger of the server and its connections.
+func WithLogger(logger *slog.Logger) Option {
+	return func(svr *Server) {
+		svr.log = logger
+	}
+}
+
+// WithMaxPacketSize sets the maximum packet sizes by listener,
+// see SetMaxPacketSize().
+func WithMaxPacketSize(sizes map[string]int) Option {
+	return func(svr *Server) {
+		svr.maxPacketSizes.Store(sizes)
+	}
+}
+
+// WithMaxSubscriptions limits the subscriptions of each connection,
+// interceptors may change Connection.MaxSubscriptions at OnConnect.
+func WithMaxSubscriptions(n int) Option {
+	return func(svr *Server) {
+		svr.maxSubscriptions = n
+	}
+}
+
+// WithStorage keeps the retained messages in the storage.
+func WithStorage(storage Storage) Option {
+	return func(svr *Server) {
+		svr.storage = storage
+	}
+}
+
+// WithListenerHook sets a function that is called when a listener stops
+// accepting connections, because it failed or the server was shut down.
+func WithListenerHook(f func(name string, err error)) Option {
+	return func(svr *Server) {
+		svr.listenerHook = f
+	}
+}
+
+////////////////////
+
+// Storage keeps the retained messages across restarts.
+// It is called from the server loop and should be fast.
+type Storage interface {
+	// StoreRetained stores the retained message of the topic,
+	// a message with an empty payload removes it.
+	StoreRetained(msg *Message) error
+	// LoadRetained returns all retained messages, it is called by Start().
+	LoadRetained(ctx context.Context) ([]*Message, error)
+	// Ping checks that the storage answers, for readiness checks.
+	Ping(ctx context.Context) error
+	// Close writes what is buffered and closes the storage,
+	// it is called by Shutdown() after the last StoreRetained().
+	Close() error
+}
@@ -0,0 +1,61 @@
+package mqtt
+
+// Origin tells where a message came from. Bridges (to remote servers, or
+// between HTTP and MQTT) pass the origin on and count the hops, so that
+// loops are detected (see SetHopLimit) and clients do not get their own
+// messages back (see SetNoLocal).
+type Origin struct {
+	// the listener of the client ("mqtt", "ws", "local", ...),
+	// the bridge the message came through, or "cluster"
+	Transport string
+	ClientID  string
+	// number of bridges the message passed
+	Hops int
+}
+
+// Hop returns the origin of a message that is passed on by a bridge.
+func (o Origin) Hop() Origin {
+	o.Hops++
+	return o
+}
+
+// DefaultHopLimit is the hop limit if none is set.
+const DefaultHopLimit = 8
+
+// HopsProperty is the MQTT 5 user property that carries Origin.Hops
+// across servers: it is sent to MQTT 5 subscribers (e.g. the bridge of
+// another server) and read from MQTT 5 publishers. Messages of MQTT 3.x
+// connections start with 0 hops, so the hop limit stops loops between
+// servers only over MQTT 5.
+const HopsProperty = "hops"
+
+// SetHopLimit sets the maximum number of hops of a message,
+// messages with more hops are dropped. 0 sets the DefaultHopLimit.
+func (svr *Server) SetHopLimit(hops int) {
+
+	svr.hopLimit.Store(int32(hops))
+}
+
+// HopLimit returns the maximum number of hops of a message.
+func (svr *Server) HopLimit() int {
+
+	if hops := int(svr.hopLimit.Load()); hops != 0 {
+		return hops
+	}
+	return DefaultHopLimit
+}
+
+// SetNoLocal stops the delivery of messages that were passed on by a bridge
+// to the client they came from, e.g. the REST event of a request that a
+// client made over MQTT.
+func (svr *Server) SetNoLocal(noLocal bool) {
+
+	svr.noLocal.Store(noLocal)
+}
+
+// echo tells if the message is an echo for the connection that must not be
+// delivered, see SetNoLocal.
+func (svr *Server) echo(conn *Connection, msg *Message) bool {
+
+	return msg.Origin.Hops != 0 && svr.noLocal.Load() && msg.Origin.ClientID == conn.ClientID
+}
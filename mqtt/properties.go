@@ -0,0 +1,232 @@
+package mqtt
+
+import (
+	"errors"
+	"strconv"
+)
+
+var UnknownProperty = errors.New("unknown property")
+
+// MQTT 5 properties
+const (
+	propContentType         = 0x03
+	propResponseTopic       = 0x08
+	propCorrelationData     = 0x09
+	propSessionExpiry       = 0x11
+	propReasonString        = 0x1F
+	propUserProperty        = 0x26
+	propMaximumPacketSize   = 0x27
+	propSubscriptionIdAvail = 0x29
+	propSharedSubAvail      = 0x2A
+)
+
+// UserProperty is a MQTT 5 user property, a key may occur more than once.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties are the MQTT 5 properties of a packet that the server and the
+// client use, the others are skipped when reading.
+type Properties struct {
+	// PUBLISH and will
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	UserProperties  []UserProperty
+
+	// CONNECT and CONNACK
+	SessionExpiry     uint32
+	MaximumPacketSize uint32
+	// CONNACK: the server does not support subscription identifiers
+	// and shared subscriptions
+	NoSubscriptionIds     bool
+	NoSharedSubscriptions bool
+
+	// CONNACK and DISCONNECT
+	ReasonString string
+}
+
+// MessageProperties returns the properties of a PUBLISH of the message.
+// The hops of the origin are a user property (see HopsProperty).
+func MessageProperties(msg *Message) *Properties {
+
+	props := &Properties{
+		ContentType:     msg.ContentType,
+		ResponseTopic:   msg.ResponseTopic,
+		CorrelationData: msg.CorrelationData,
+		UserProperties:  msg.UserProperties,
+	}
+	if msg.Origin.Hops != 0 {
+		hops := UserProperty{Key: HopsProperty, Value: strconv.Itoa(msg.Origin.Hops)}
+		props.UserProperties = append(props.UserProperties[:len(props.UserProperties):len(props.UserProperties)], hops)
+	}
+	return props
+}
+
+// SetProperties sets the fields of a received message from its properties.
+func (msg *Message) SetProperties(props *Properties) {
+
+	msg.ContentType = props.ContentType
+	msg.ResponseTopic = props.ResponseTopic
+	msg.CorrelationData = props.CorrelationData
+	for _, prop := range props.UserProperties {
+		if prop.Key == HopsProperty {
+			msg.Origin.Hops, _ = strconv.Atoi(prop.Value)
+		} else {
+			msg.UserProperties = append(msg.UserProperties, prop)
+		}
+	}
+}
+
+// AppendProperties appends the properties with their length,
+// nil appends no properties.
+func AppendProperties(b []byte, props *Properties) []byte {
+
+	var p []byte
+	if props != nil {
+		if props.ContentType != "" {
+			p = append(p, propContentType)
+			p = appendString(p, props.ContentType)
+		}
+		if props.ResponseTopic != "" {
+			p = append(p, propResponseTopic)
+			p = appendString(p, props.ResponseTopic)
+		}
+		if props.CorrelationData != nil {
+			p = append(p, propCorrelationData)
+			p = appendString(p, string(props.CorrelationData))
+		}
+		if props.SessionExpiry != 0 {
+			p = append(p, propSessionExpiry)
+			p = appendUint32(p, props.SessionExpiry)
+		}
+		if props.MaximumPacketSize != 0 {
+			p = append(p, propMaximumPacketSize)
+			p = appendUint32(p, props.MaximumPacketSize)
+		}
+		if props.NoSubscriptionIds {
+			p = append(p, propSubscriptionIdAvail, 0)
+		}
+		if props.NoSharedSubscriptions {
+			p = append(p, propSharedSubAvail, 0)
+		}
+		if props.ReasonString != "" {
+			p = append(p, propReasonString)
+			p = appendString(p, props.ReasonString)
+		}
+		for _, prop := range props.UserProperties {
+			p = append(p, propUserProperty)
+			p = appendString(p, prop.Key)
+			p = appendString(p, prop.Value)
+		}
+	}
+	b = appendVarint(b, len(p))
+	return append(b, p...)
+}
+
+// ReadProperties reads the properties with their length,
+// it returns the number of bytes read.
+func ReadProperties(buf []byte) (int, *Properties, error) {
+
+	l, length := readVarint(buf)
+	if l == 0 || len(buf) < l+length {
+		return 0, nil, IncompleteMessage
+	}
+	props := new(Properties)
+	p := buf[l : l+length]
+	for len(p) != 0 {
+		id := p[0]
+		p = p[1:]
+		var n int
+		switch id {
+		case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2A: // byte
+			n = 1
+		case 0x13, 0x21, 0x22, 0x23: // two byte integer
+			n = 2
+		case 0x02, 0x18: // four byte integer
+			n = 4
+		case propSessionExpiry:
+			n, props.SessionExpiry = readUint32(p)
+		case propMaximumPacketSize:
+			n, props.MaximumPacketSize = readUint32(p)
+		case 0x0B: // variable byte integer
+			n, _ = readVarint(p)
+		case propContentType:
+			n, props.ContentType = readString(p)
+		case propResponseTopic:
+			n, props.ResponseTopic = readString(p)
+		case propCorrelationData:
+			n, props.CorrelationData = readBytes(p)
+		case propReasonString:
+			n, props.ReasonString = readString(p)
+		case 0x12, 0x15, 0x16, 0x1A, 0x1C: // string or binary
+			n, _ = readBytes(p)
+		case propUserProperty:
+			k, key := readString(p)
+			if k != 0 {
+				v, value := readString(p[k:])
+				if v != 0 {
+					n = k + v
+					props.UserProperties = append(props.UserProperties, UserProperty{Key: key, Value: value})
+				}
+			}
+		default:
+			return 0, nil, UnknownProperty
+		}
+		if n == 0 || len(p) < n {
+			return 0, nil, IncompleteMessage
+		}
+		p = p[n:]
+	}
+	return l + length, props, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendVarint(b []byte, n int) []byte {
+	for {
+		c := byte(n & 127)
+		n >>= 7
+		if n != 0 {
+			c |= 128 // more bytes follow
+		}
+		b = append(b, c)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func readUint32(buf []byte) (int, uint32) {
+
+	if len(buf) < 4 {
+		return 0, 0
+	}
+	return 4, uint32(buf[0])<<24 | uint32(buf[1])<<16 | uint32(buf[2])<<8 | uint32(buf[3])
+}
+
+func readVarint(buf []byte) (int, int) {
+
+	var n, multiplier int = 0, 1
+	for i, c := range buf {
+		if i == 4 {
+			break
+		}
+		n += int(c&127) * multiplier
+		if c&128 == 0 {
+			return i + 1, n
+		}
+		multiplier *= 128
+	}
+	return 0, 0
+}
@@ -1,12 +1,21 @@
 package mqtt
 
 import (
+	"context"
+	"crypto/tls"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/j-forster/mqtt/tools"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type SubscriptionRequest struct {
@@ -29,73 +38,337 @@ type Server struct {
 
 	//subsReq chan SubscriptionRequest
 	//unsubs chan *Subscription
-	state    int
-	closer   io.Closer
+	// read by every connection, see Alive()
+	state atomic.Int32
+	// closed when the server loop stops, the channels below are never
+	// closed: senders select on sigclose
 	sigclose chan (struct{})
 	subs     chan SubscriptionChange
 	pub      chan *Message
+	calls    chan func()
 	topics   *Topic
-	handler  Handler
-	debug    bool
+	// see AddInterceptor()
+	interceptors []Interceptor
+	log          *slog.Logger
+
+	connsMutex sync.Mutex
+	conns      map[*Connection]struct{}
+
+	// maximum packet sizes by listener, see SetMaxPacketSize()
+	maxPacketSizes atomic.Value // map[string]int
+	// see SetHopLimit() and SetNoLocal()
+	hopLimit atomic.Int32
+	noLocal  atomic.Bool
+	// default of Connection.MaxSubscriptions
+	maxSubscriptions int
+	storage          Storage
+
+	listenersMutex sync.Mutex
+	listeners      map[string]net.Listener
+	listenerHook   func(name string, err error)
+	shutdownHook   func()
+	started        bool
+	// closed when Run() returns
+	stopped chan struct{}
 }
 
-func NewServer(closer io.Closer, handler Handler) *Server {
+// NewServer creates a server with the options. Add listeners with
+// AddListener() and call Start() to run it.
+func NewServer(opts ...Option) *Server {
 
 	svr := new(Server)
 	//svr.subsReq = make(chan SubscriptionRequest)
 	//svr.unsubs = make(chan *Subscription)
-	svr.closer = closer
-	svr.handler = handler
 	svr.sigclose = make(chan struct{})
+	svr.stopped = make(chan struct{})
 	svr.subs = make(chan SubscriptionChange)
 	svr.pub = make(chan *Message)
+	svr.calls = make(chan func())
 	svr.topics = NewTopic(nil, "")
+	svr.conns = make(map[*Connection]struct{})
+	svr.log = slog.Default()
+	svr.maxPacketSizes.Store(map[string]int(nil))
+	svr.listeners = make(map[string]net.Listener)
+	for _, opt := range opts {
+		opt(svr)
+	}
 	return svr
 }
 
-func (svr *Server) SetDebug(debug bool) {
+// Start loads the retained messages from the storage, starts the server loop
+// and accepts connections at the listeners.
+func (svr *Server) Start(ctx context.Context) error {
 
-	svr.debug = debug
-}
+	svr.listenersMutex.Lock()
+	defer svr.listenersMutex.Unlock()
 
-func (svr *Server) Alive() bool {
+	if svr.started {
+		return ServerStarted
+	}
 
-	return svr.state != CLOSING && svr.state != CLOSED
+	if svr.storage != nil {
+		msgs, err := svr.storage.LoadRetained(ctx)
+		if err != nil {
+			return err
+		}
+		// the server loop is not running yet
+		for _, msg := range msgs {
+			msg.retain = true
+			svr.topics.Publish(strings.Split(msg.Topic, "/"), msg)
+		}
+		svr.log.Info("retained messages loaded", "count", len(msgs))
+	}
+
+	svr.started = true
+	go svr.Run()
+	for name, listener := range svr.listeners {
+		go svr.accept(name, listener)
+	}
+	return nil
 }
 
-func (svr *Server) Publish(conn *Connection, msg *Message) {
+// AddListener makes the server accept connections at the listener,
+// the name is used for metrics and per listener settings.
+// The listener is closed when the server is shut down.
+func (svr *Server) AddListener(name string, listener net.Listener) {
+
+	svr.listenersMutex.Lock()
+	defer svr.listenersMutex.Unlock()
 
 	if !svr.Alive() {
+		listener.Close()
 		return
 	}
+	svr.listeners[name] = listener
+	if svr.started {
+		go svr.accept(name, listener)
+	}
+}
 
-	var err error = nil
-	if svr.handler != nil {
-		err = svr.handler.Publish(conn, msg)
+func (svr *Server) accept(name string, listener net.Listener) {
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if svr.Alive() {
+				svr.log.Error("accept failed", "listener", name, "error", err)
+			}
+			if svr.listenerHook != nil {
+				svr.listenerHook(name, err)
+			}
+			return
+		}
+		go svr.ServeListener(name, conn)
 	}
-	if err == nil {
+}
+
+// closeListeners stops accepting new connections.
+func (svr *Server) closeListeners() {
+
+	svr.listenersMutex.Lock()
+	for name, listener := range svr.listeners {
+		listener.Close()
+		delete(svr.listeners, name)
+	}
+	svr.listenersMutex.Unlock()
+}
+
+// SetLogger sets the logger of the server and its connections.
+// Messages and topic changes are logged at debug level.
+func (svr *Server) SetLogger(logger *slog.Logger) {
+
+	svr.log = logger
+}
+
+// SetMaxPacketSize sets the maximum size of packets that clients of the
+// listeners may send, "*" applies to all other listeners.
+// Sizes up to MaxRemainingLength are allowed, the default is DefaultMaxPacketSize.
+func (svr *Server) SetMaxPacketSize(sizes map[string]int) {
+
+	svr.maxPacketSizes.Store(sizes)
+}
+
+// MaxPacketSize returns the maximum packet size of the listener.
+func (svr *Server) MaxPacketSize(listener string) int {
+
+	sizes := svr.maxPacketSizes.Load().(map[string]int)
+	if size, ok := sizes[listener]; ok {
+		return size
+	}
+	if size, ok := sizes["*"]; ok {
+		return size
+	}
+	return DefaultMaxPacketSize
+}
+
+// OnShutdown sets a function that Shutdown() calls when the deliveries
+// are drained and the clients are disconnected, before the server loop
+// and the storage are closed. Call it before Start().
+func (svr *Server) OnShutdown(f func()) {
+	svr.shutdownHook = f
+}
+
+func (svr *Server) Alive() bool {
+
+	state := svr.state.Load()
+	return state != CLOSING && state != CLOSED
+}
+
+// closing marks the server as CLOSING,
+// it returns false if it was closing already.
+func (svr *Server) closing() bool {
 
-		svr.pub <- msg
+	for {
+		state := svr.state.Load()
+		if state == CLOSING || state == CLOSED {
+			return false
+		}
+		if svr.state.CompareAndSwap(state, CLOSING) {
+			return true
+		}
 	}
 }
 
-func (svr *Server) Subscribe(conn *Connection, topic string, qos byte) *Subscription {
+func (svr *Server) addConnection(conn *Connection) {
+
+	svr.connsMutex.Lock()
+	svr.conns[conn] = struct{}{}
+	svr.connsMutex.Unlock()
+}
+
+func (svr *Server) removeConnection(conn *Connection) {
+
+	svr.connsMutex.Lock()
+	delete(svr.conns, conn)
+	svr.connsMutex.Unlock()
+}
+
+// Connections returns a snapshot of all connections currently known to the server.
+func (svr *Server) Connections() []*Connection {
+
+	svr.connsMutex.Lock()
+	conns := make([]*Connection, 0, len(svr.conns))
+	for conn := range svr.conns {
+		conns = append(conns, conn)
+	}
+	svr.connsMutex.Unlock()
+	return conns
+}
+
+// Publish passes the message through the interceptors to the subscribers.
+// conn is nil for messages published in-process (see NewMessage).
+// It returns an error if the message was refused or the server is closing.
+func (svr *Server) Publish(conn *Connection, msg *Message) error {
+
+	return svr.publish(conn, msg)
+}
+
+func (svr *Server) publish(conn *Connection, msg *Message) error {
 
 	if !svr.Alive() {
+		droppedMessages.With("closing").Inc()
+		return Reject(SERVER_SHUTTING_DOWN, "server closing")
+	}
+
+	msg.received = time.Now()
+	if msg.Origin.Transport == "" && conn != nil {
+		// the hops of a MQTT 5 publisher, if it is a bridge
+		msg.Origin = Origin{Transport: conn.Listener, ClientID: conn.ClientID, Hops: msg.Origin.Hops}
+	}
+	if msg.Origin.Hops > svr.HopLimit() {
+		svr.log.Warn("hop limit exceeded", "topic", msg.Topic, "hops", msg.Origin.Hops,
+			"transport", msg.Origin.Transport, "client", msg.Origin.ClientID)
+		droppedMessages.With("hop_limit").Inc()
+		return HopLimitExceeded
+	}
+
+	// continue the trace of the message, it might come from the
+	// user properties or from the context of an in-process publish
+	ctx := msg.ctx
+	if ctx == nil {
+		ctx = otel.GetTextMapPropagator().Extract(context.Background(), propertiesCarrier{msg})
+	}
+	kind := trace.SpanKindInternal
+	attrs := []attribute.KeyValue{attribute.String("mqtt.topic", msg.Topic), attribute.Int("mqtt.qos", int(msg.QoS))}
+	if conn != nil {
+		kind = trace.SpanKindServer
+		attrs = append(attrs, attribute.String("mqtt.client_id", conn.ClientID))
+	}
+	ctx, span := tracer.Start(ctx, "mqtt.publish", trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+	defer span.End()
+	msg.ctx = ctx
+	otel.GetTextMapPropagator().Inject(ctx, propertiesCarrier{msg})
+
+	err := svr.interceptPublish(conn, msg)
+	if err == nil {
+
+		publishQueue.With().Inc()
+		select {
+		case svr.pub <- msg:
+		case <-svr.sigclose:
+			// closed after Alive()
+			publishQueue.With().Dec()
+			droppedMessages.With("closing").Inc()
+			return Reject(SERVER_SHUTTING_DOWN, "server closing")
+		}
+	} else if err == Consumed {
+
 		return nil
+	} else {
+
+		span.SetStatus(codes.Error, err.Error())
+		if ReasonCode(err) == QUOTA_EXCEEDED {
+			droppedMessages.With("quota").Inc()
+			// MQTT 3.x clients can not be told, the message is just dropped
+			if conn != nil && conn.Version >= 5 {
+				conn.Disconnect(QUOTA_EXCEEDED)
+				return ClientDisconnected
+			}
+		} else {
+			droppedMessages.With("refused").Inc()
+		}
 	}
+	return err
+}
 
-	var err error = nil
-	if svr.handler != nil {
-		err = svr.handler.Subscribe(conn, topic, qos)
+func (svr *Server) Subscribe(conn *Connection, topic string, qos byte) (*Subscription, error) {
+
+	if !svr.Alive() {
+		return nil, Reject(SERVER_SHUTTING_DOWN, "server closing")
 	}
+
+	_, span := tracer.Start(context.Background(), "mqtt.subscribe", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("mqtt.topic", topic), attribute.String("mqtt.client_id", conn.ClientID)))
+	defer span.End()
+
+	err := svr.interceptSubscribe(conn, topic, qos)
 	if err == nil {
 
 		subs := NewSubscription(conn, qos)
-		svr.subs <- SubscriptionChange{CREATE, subs, topic}
-		return subs
+		subs.filter = topic
+		if !svr.change(SubscriptionChange{CREATE, subs, topic}) {
+			return nil, Reject(SERVER_SHUTTING_DOWN, "server closing")
+		}
+		return subs, nil
 	}
-	return nil
+	span.SetStatus(codes.Error, err.Error())
+	return nil, err
+}
+
+// SubscribeFunc subscribes f to the topic filter in-process, without
+// interceptors. f is called from the server loop and must not block.
+// Cancel the subscription with Unsubscribe().
+func (svr *Server) SubscribeFunc(topic string, qos byte, f func(msg *Message)) *Subscription {
+
+	if !svr.Alive() {
+		return nil
+	}
+
+	subs := &Subscription{fn: f, qos: qos, filter: topic}
+	if !svr.change(SubscriptionChange{CREATE, subs, topic}) {
+		return nil
+	}
+	return subs
 }
 
 func (svr *Server) Unsubscribe(subs *Subscription) {
@@ -104,27 +377,40 @@ func (svr *Server) Unsubscribe(subs *Subscription) {
 		return
 	}
 
-	svr.subs <- SubscriptionChange{REMOVE, subs, ""}
+	svr.change(SubscriptionChange{REMOVE, subs, ""})
+}
+
+// change passes the change to the server loop,
+// it returns false if the server is closed.
+func (svr *Server) change(evt SubscriptionChange) bool {
+
+	select {
+	case svr.subs <- evt:
+		return true
+	case <-svr.sigclose:
+		return false
+	}
 }
 
 func (svr *Server) Run() {
 
+	defer close(svr.stopped)
+
 RUN:
 	for {
 		select {
 		case <-svr.sigclose:
 
-			close(svr.subs)
-			close(svr.pub)
-
 			SYSALL := []string{"$SYS", "all"}
 			subs := svr.topics.Find(SYSALL)
 			for ; subs != nil; subs = subs.next {
 
-				subs.conn.Close()
+				if subs.conn != nil {
+					subs.conn.Close()
+				}
 			}
 
-			svr.state = CLOSED
+			svr.state.Store(CLOSED)
 			break RUN
 
 		case evt := <-svr.subs:
@@ -132,15 +418,27 @@ RUN:
 			switch evt.action {
 			case CREATE:
 				svr.topics.Subscribe(strings.Split(evt.topic, "/"), evt.subs)
+				subscriptions.With().Inc()
 
 			case REMOVE:
+				if evt.subs.topic != nil {
+					subscriptions.With().Dec()
+				}
 				evt.subs.Unsubscribe()
 			}
 
-			log.Println("[DEBUG] Topics:", svr.topics)
+			if svr.log.Enabled(context.Background(), slog.LevelDebug) {
+				svr.log.Debug("topics changed", "topics", svr.topics.String())
+			}
+
+		case call := <-svr.calls:
+
+			call()
 
 		case msg := <-svr.pub:
 
+			publishQueue.With().Dec()
+
 			if msg.Topic == "$SYS/close" {
 				// svr.Close()
 
@@ -151,10 +449,15 @@ RUN:
 					n = 30
 				}
 
-				if svr.debug {
-					log.Printf("[DEBUG] Publish: %q: %q", msg.Topic, string(msg.Buf[:n]))
-				}
+				svr.log.Debug("publish", "topic", msg.Topic, "payload", string(msg.Buf[:n]), "size", len(msg.Buf))
+				_, span := tracer.Start(msg.Context(), "mqtt.fanout",
+					trace.WithAttributes(attribute.String("mqtt.topic", msg.Topic)))
 				svr.topics.Publish(strings.Split(msg.Topic, "/"), msg)
+				if msg.retain {
+					svr.storeRetained(msg)
+				}
+				span.End()
+				publishLatency.With().Since(msg.received)
 			}
 		}
 	}
@@ -162,21 +465,167 @@ RUN:
 
 func (svr *Server) Close() {
 
-	if svr.Alive() {
+	if svr.closing() {
 
+		svr.closeListeners()
 		close(svr.sigclose)
-		svr.state = CLOSING
-		if svr.closer != nil {
-			svr.closer.Close()
+	}
+}
+
+func (svr *Server) storeRetained(msg *Message) {
+
+	if svr.storage != nil {
+		if err := svr.storage.StoreRetained(msg); err != nil {
+			svr.log.Error("storing retained message failed", "topic", msg.Topic, "error", err)
 		}
 	}
 }
 
+// Storage returns the storage of the retained messages, nil if there is none.
+func (svr *Server) Storage() Storage {
+	return svr.storage
+}
+
+// do runs f in the server loop, where the topic tree can be accessed safely.
+// It returns false if the server is closed.
+func (svr *Server) do(f func()) bool {
+
+	done := make(chan struct{})
+	select {
+	case svr.calls <- func() { f(); close(done) }:
+		<-done
+		return true
+	case <-svr.sigclose:
+		return false
+	}
+}
+
+// Topics returns a snapshot of the topic tree.
+func (svr *Server) Topics() *TopicInfo {
+
+	var info *TopicInfo
+	svr.do(func() {
+		info = svr.topics.Info()
+	})
+	return info
+}
+
+// Retained returns the retained messages of all topics.
+func (svr *Server) Retained() []*Message {
+
+	var msgs []*Message
+	svr.do(func() {
+		msgs = svr.topics.Retained()
+	})
+	return msgs
+}
+
+// DeleteRetained removes the retained message of the topic.
+// It returns false if there was no retained message.
+func (svr *Server) DeleteRetained(topic string) bool {
+
+	var ok bool
+	svr.do(func() {
+		ok = svr.topics.DeleteRetained(strings.Split(topic, "/"))
+		if ok {
+			svr.storeRetained(&Message{Topic: topic, retain: true})
+		}
+	})
+	return ok
+}
+
+// Shutdown stops the server gracefully: the listeners are closed, new
+// publishes and subscriptions are refused, outstanding QoS 1 and 2 deliveries get the chance to complete,
+// every client is sent a DISCONNECT, the OnShutdown() function is called and
+// the server is closed. When the
+// server loop has stopped, the storage is closed.
+// If ctx expires before all deliveries are acknowledged, the remaining
+// connections are dropped and ctx.Err() is returned.
+func (svr *Server) Shutdown(ctx context.Context) error {
+
+	if !svr.closing() {
+		return nil
+	}
+	svr.closeListeners()
+
+	var err error
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+FLUSH:
+	for {
+		inflight := 0
+		for _, conn := range svr.Connections() {
+			inflight += conn.Inflight()
+		}
+		if inflight == 0 {
+			break FLUSH
+		}
+		select {
+		case <-ctx.Done():
+			svr.log.Warn("shutdown: dropping unacknowledged messages", "inflight", inflight)
+			err = ctx.Err()
+			break FLUSH
+		case <-ticker.C:
+		}
+	}
+
+	for _, conn := range svr.Connections() {
+		conn.Disconnect(SERVER_SHUTTING_DOWN)
+	}
+
+	if svr.shutdownHook != nil {
+		svr.shutdownHook()
+	}
+	close(svr.sigclose)
+
+	svr.listenersMutex.Lock()
+	started := svr.started
+	svr.listenersMutex.Unlock()
+	if started {
+		// the loop is the only writer of the storage
+		<-svr.stopped
+	}
+	if svr.storage != nil {
+		if cerr := svr.storage.Close(); cerr != nil {
+			svr.log.Error("closing the storage failed", "error", cerr)
+			if err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
 func (svr *Server) Serve(rwc io.ReadWriteCloser) {
+	svr.ServeListener("", rwc)
+}
+
+// ServeListener serves the connection like Serve, listener names the
+// listener that accepted the connection.
+func (svr *Server) ServeListener(listener string, rwc io.ReadWriteCloser) {
 
 	// uconn := tools.Unblock(rwc)
 
+	var state *tls.ConnectionState
+	if tlsConn, ok := rwc.(*tls.Conn); ok {
+		// complete the handshake so that the handler can
+		// see the client certificate at CONNECT
+		if err := tlsConn.Handshake(); err != nil {
+			svr.log.Warn("TLS handshake failed", "remote", tlsConn.RemoteAddr().String(), "error", err)
+			rwc.Close()
+			return
+		}
+		cs := tlsConn.ConnectionState()
+		state = &cs
+	}
+
 	conn := NewConnection(rwc, rwc, svr)
+	conn.TLS = state
+	conn.Listener = listener
+	if netConn, ok := rwc.(net.Conn); ok {
+		conn.RemoteAddr = netConn.RemoteAddr().String()
+	}
 	defer conn.Close()
 
 	// conn.Subscribe("$SYS/all", 0)
@@ -200,6 +649,7 @@ func Join(conn net.Conn, server *Server) {
 	}
 }
 
+// ListenAndServe runs a server with the handler at the TCP address.
 func ListenAndServe(addr string, handler Handler) error {
 
 	tcp, err := net.Listen("tcp", addr)
@@ -207,20 +657,13 @@ func ListenAndServe(addr string, handler Handler) error {
 		return err
 	}
 
-	server := NewServer(tcp, handler)
-	go server.Run()
-
-	for {
-
-		conn, err := tcp.Accept()
-		if err == nil {
-
-			go server.Serve(conn)
-		} else {
-
-			return err
-		}
+	errs := make(chan error, 1)
+	server := NewServer(WithHandler(handler), WithListenerHook(func(name string, err error) {
+		errs <- err
+	}))
+	server.AddListener("", tcp)
+	if err := server.Start(context.Background()); err != nil {
+		return err
 	}
-
-	return nil
+	return <-errs
 }
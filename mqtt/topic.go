@@ -1,6 +1,7 @@
 package mqtt
 
 import (
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -9,6 +10,10 @@ import (
 
 type Subscription struct {
 	conn *Connection
+	// in-process subscriptions have a function instead of a connection
+	fn func(msg *Message)
+	// the topic filter of the subscription
+	filter string
 	// topic string
 	topic *Topic
 
@@ -30,11 +35,20 @@ func (s *Subscription) Publish(msg *Message) {
 		return
 	}
 
-	s.conn.Publish(s, msg)
+	s.deliver(msg)
 
 	s.next.Publish(msg)
 }
 
+func (s *Subscription) deliver(msg *Message) {
+
+	if s.fn != nil {
+		s.fn(msg)
+	} else {
+		s.conn.Publish(s, msg)
+	}
+}
+
 func (s *Subscription) ChainLength() int {
 	if s == nil {
 		return 0
@@ -131,21 +145,29 @@ func (topic *Topic) Publish(s []string, msg *Message) {
 
 		// attach retain message to the topic
 		if msg.retain {
-			topic.retainMsg = msg
+			if len(msg.Buf) == 0 {
+				// an empty retain message removes the retain message
+				topic.removeRetained()
+			} else {
+				if topic.retainMsg == nil {
+					retainedMessages.With().Inc()
+				}
+				topic.retainMsg = msg
+			}
 		}
 	} else {
 
 		// search for the child note
 		t, ok := topic.children[s[0]]
+		if !ok && msg.retain && len(msg.Buf) != 0 {
+			// retain messages are attached to a topic
+			// se we need to create the topic as it does not exist
+			t = NewTopic(topic, s[0])
+			topic.children[s[0]] = t
+			ok = true
+		}
 		if ok {
 			t.Publish(s[1:], msg)
-		} else {
-
-			if msg.retain {
-				// retain messages are attached to a topic
-				// se we need to create the topic as it does not exist
-				t.Subscribe(s[1:], nil)
-			}
 		}
 
 		// notify all ../+ subscribers
@@ -158,6 +180,118 @@ func (topic *Topic) Publish(s []string, msg *Message) {
 	topic.mlwcSubs.Publish(msg)
 }
 
+// DeleteRetained removes the retain message of the topic s.
+func (topic *Topic) DeleteRetained(s []string) bool {
+
+	if len(s) == 0 {
+		if topic.retainMsg == nil {
+			return false
+		}
+		topic.removeRetained()
+		return true
+	}
+	t, ok := topic.children[s[0]]
+	if !ok {
+		return false
+	}
+	return t.DeleteRetained(s[1:])
+}
+
+func (topic *Topic) removeRetained() {
+
+	if topic.retainMsg == nil {
+		return
+	}
+	topic.retainMsg = nil
+	retainedMessages.With().Dec()
+
+	if topic.subs == nil && // no subscribers
+		topic.mlwcSubs == nil && // no /# subscribers
+		topic.wcTopic == nil && // no /+ topic
+		len(topic.children) == 0 { // no sub-topics
+		topic.Remove()
+	}
+}
+
+// TopicInfo is a snapshot of a topic and its sub-topics.
+type TopicInfo struct {
+	Name string `json:"name"`
+	// number of subscriptions to this topic
+	Subscribers int `json:"subscribers,omitempty"`
+	// number of subscriptions to /#
+	WildcardSubscribers int `json:"wildcard_subscribers,omitempty"`
+	// size of the retain message, if any
+	Retained *int `json:"retained,omitempty"`
+	// sub topics, including the + topic
+	Children []*TopicInfo `json:"children,omitempty"`
+}
+
+// Info returns a snapshot of the topic tree below this topic.
+func (topic *Topic) Info() *TopicInfo {
+
+	info := &TopicInfo{
+		Name:                topic.name,
+		Subscribers:         topic.subs.ChainLength(),
+		WildcardSubscribers: topic.mlwcSubs.ChainLength(),
+	}
+	if topic.retainMsg != nil {
+		size := len(topic.retainMsg.Buf)
+		info.Retained = &size
+	}
+	names := make([]string, 0, len(topic.children))
+	for name := range topic.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info.Children = append(info.Children, topic.children[name].Info())
+	}
+	if topic.wcTopic != nil {
+		info.Children = append(info.Children, topic.wcTopic.Info())
+	}
+	return info
+}
+
+// Retained returns the retained messages of this topic and its sub-topics.
+func (topic *Topic) Retained() []*Message {
+
+	var msgs []*Message
+	if topic.retainMsg != nil {
+		msgs = append(msgs, topic.retainMsg)
+	}
+	for _, child := range topic.children {
+		msgs = append(msgs, child.Retained()...)
+	}
+	return msgs
+}
+
+// Match tells if the topic (or topic filter) is covered by the filter.
+func Match(filter string, topic string) bool {
+
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i == len(t) {
+			return false
+		}
+		if level == "+" {
+			if t[i] == "#" {
+				// '+' does not cover a multi-level wildcard
+				return false
+			}
+			continue
+		}
+		if level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
 func (topic *Topic) FullName() string {
 	if topic.parent != nil {
 		return topic.parent.FullName() + "/" + topic.name
@@ -220,7 +354,7 @@ func (topic *Topic) Subscribe(t []string, sub *Subscription) {
 
 		topic.Enqueue(&topic.subs, sub)
 		if topic.retainMsg != nil {
-			sub.conn.Publish(sub, topic.retainMsg)
+			sub.deliver(topic.retainMsg)
 		}
 
 	} else {
@@ -0,0 +1,44 @@
+package mqtt
+
+import (
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a", false},
+		{"a", "a/b", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+", "a", false},
+		{"+/b", "a/b", true},
+		{"+/+", "a/b", true},
+		{"+", "", true},
+		{"+/a", "/a", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/c", false},
+		{"#", "a/b", true},
+		{"a/b/#", "a/b/c/d", true},
+		{"a/b/#", "a/c/d", false},
+		// topic filters, e.g. of subscriptions checked by the ACL
+		{"a/+", "a/+", true},
+		{"a/#", "a/+/c", true},
+		{"a/#", "a/#", true},
+		{"a/+", "a/#", false},
+		{"a/b", "a/+", false},
+		{"a/+/c", "a/#", false},
+	}
+	for _, test := range tests {
+		if match := Match(test.filter, test.topic); match != test.match {
+			t.Errorf("Match(%q, %q) = %v, want %v", test.filter, test.topic, match, test.match)
+		}
+	}
+}
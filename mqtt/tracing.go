@@ -0,0 +1,60 @@
+package mqtt
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+)
+
+var tracer = otel.Tracer("github.com/j-forster/Waziup-API/mqtt")
+
+// Context returns the context of the message, like http.Request.Context.
+// It carries the trace of the message through the server.
+func (msg *Message) Context() context.Context {
+	if msg.ctx != nil {
+		return msg.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of msg with its context changed to ctx.
+func (msg *Message) WithContext(ctx context.Context) *Message {
+	msg2 := new(Message)
+	*msg2 = *msg
+	msg2.ctx = ctx
+	return msg2
+}
+
+// propertiesCarrier reads and writes the trace context in user properties.
+// They are sent to and read from MQTT 5 clients, the messages of MQTT 3.x
+// clients start a new trace.
+type propertiesCarrier struct {
+	msg *Message
+}
+
+func (c propertiesCarrier) Get(key string) string {
+	for _, prop := range c.msg.UserProperties {
+		if prop.Key == key {
+			return prop.Value
+		}
+	}
+	return ""
+}
+
+func (c propertiesCarrier) Set(key string, value string) {
+	for i, prop := range c.msg.UserProperties {
+		if prop.Key == key {
+			c.msg.UserProperties[i].Value = value
+			return
+		}
+	}
+	c.msg.UserProperties = append(c.msg.UserProperties, UserProperty{key, value})
+}
+
+func (c propertiesCarrier) Keys() []string {
+	keys := make([]string, len(c.msg.UserProperties))
+	for i, prop := range c.msg.UserProperties {
+		keys[i] = prop.Key
+	}
+	return keys
+}
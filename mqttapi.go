@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/j-forster/Waziup-API/mqtt"
+	"github.com/j-forster/Waziup-API/tools"
+)
+
+// The REST API is available over MQTT, for devices that can not use HTTP:
+//
+// A message published at a topic is handled by the POST route of the same
+// path, if there is one, e.g. "devices/<id>/shadow/reported" like a HTTP POST
+// at "/devices/<id>/shadow/reported". The message is delivered to the
+// subscribers of the topic as well. Messages at topics without a route are
+// not passed to the REST API.
+//
+// A message published at "api/<method>/<path>" is a request, e.g.
+// "api/get/devices" for GET /devices, with the payload as body. The request
+// is not delivered to subscribers. The reply (see mqttReply) is published at
+// the MQTT 5 response topic of the request, with its correlation data, or at
+// "api/reply/<client ID>". The user must be allowed to publish at the
+// response topic.
+// A query in the topic ("api/get/devices?id=1") is part of the request URI
+// and repeated in the reply.
+//
+// The requests are made as the user of the MQTT connection.
+
+const apiTopics = "api/"
+
+// mqttReply is the reply to a request at "api/<method>/<path>".
+type mqttReply struct {
+	Status      int    `json:"status"`
+	Method      string `json:"method"`
+	URI         string `json:"uri"`
+	ContentType string `json:"content_type,omitempty"`
+	// the response body if it is JSON, body_base64 otherwise
+	Body       json.RawMessage `json:"body,omitempty"`
+	BodyBase64 []byte          `json:"body_base64,omitempty"`
+}
+
+// mqttUserKey and mqttOriginKey are the context keys of the user of the
+// MQTT connection and the origin of the message, for requests that arrived
+// over MQTT.
+type mqttUserKey struct{}
+type mqttOriginKey struct{}
+
+// mqttUser returns the user of a request that arrived over MQTT.
+func mqttUser(req *http.Request) (user string, ok bool) {
+
+	user, ok = req.Context().Value(mqttUserKey{}).(string)
+	return
+}
+
+// newMQTTRequest creates the request of a MQTT message,
+// nil if the uri is invalid.
+func newMQTTRequest(conn *mqtt.Connection, msg *mqtt.Message, method, uri string) *http.Request {
+
+	rurl, err := url.Parse(uri)
+	if err != nil {
+		return nil
+	}
+	header := http.Header{
+		"X-Tag": []string{"MQTT "},
+	}
+	if msg.ContentType != "" {
+		header.Set("Content-Type", msg.ContentType)
+	}
+	req := &http.Request{
+		Method:        method,
+		URL:           rurl,
+		Header:        header,
+		Body:          &tools.ClosingBuffer{Buffer: bytes.NewBuffer(msg.Buf)},
+		ContentLength: int64(len(msg.Buf)),
+		RemoteAddr:    conn.ClientID,
+		RequestURI:    uri,
+	}
+	// continue the trace of the message
+	ctx := context.WithValue(msg.Context(), mqttUserKey{}, connUser(conn))
+	ctx = context.WithValue(ctx, mqttOriginKey{}, msg.Origin)
+	return req.WithContext(ctx)
+}
+
+// requestOrigin returns the origin of the request: the origin of the message
+// if it arrived over MQTT, the device or the IP otherwise.
+func requestOrigin(req *http.Request) mqtt.Origin {
+
+	if origin, ok := req.Context().Value(mqttOriginKey{}).(mqtt.Origin); ok {
+		return origin
+	}
+	client := req.Header.Get("X-Device-Id")
+	if client == "" {
+		client = remoteHost(req.RemoteAddr)
+	}
+	return mqtt.Origin{
+		Transport: strings.ToLower(strings.TrimSpace(req.Header.Get("X-Tag"))),
+		ClientID:  client,
+	}
+}
+
+// serveAPIRequest answers a request at "api/<method>/<path>".
+func serveAPIRequest(conn *mqtt.Connection, msg *mqtt.Message) {
+
+	replyTopic := msg.ResponseTopic
+	if replyTopic == "" {
+		replyTopic = "api/reply/" + conn.ClientID
+	} else if strings.HasPrefix(replyTopic, clusterTopics) || !currentConfig().Allowed(connUser(conn), replyTopic, WRITE) {
+		// the client could not publish there itself
+		logMQTT.Warn("reply topic denied", "client", conn.ClientID, "topic", replyTopic)
+		return
+	}
+	if strings.ContainsAny(replyTopic, "+#") {
+		logMQTT.Warn("invalid reply topic", "client", conn.ClientID, "topic", replyTopic)
+		return
+	}
+
+	method, path, _ := strings.Cut(strings.TrimPrefix(msg.Topic, apiTopics), "/")
+	method = strings.ToUpper(method)
+	reply := mqttReply{
+		Method: method,
+		URI:    "/" + path,
+	}
+	resp := MQTTResponse{
+		status: 200,
+		header: make(http.Header),
+	}
+	if method == "PUBLISH" {
+		http.Error(&resp, "Method Not Allowed: Publish to the topic instead.", http.StatusMethodNotAllowed)
+	} else if req := newMQTTRequest(conn, msg, method, reply.URI); req != nil {
+		Serve(&resp, req)
+	} else {
+		http.Error(&resp, "Bad Request: Invalid path.", http.StatusBadRequest)
+	}
+
+	reply.Status = resp.status
+	reply.ContentType = resp.header.Get("Content-Type")
+	body := resp.body.Bytes()
+	if json.Valid(body) {
+		reply.Body = body
+	} else {
+		reply.BodyBase64 = body
+	}
+	data, _ := json.Marshal(&reply)
+	out := mqtt.NewMessage(replyTopic, data, msg.QoS, false)
+	out.ContentType = "application/json"
+	out.CorrelationData = msg.CorrelationData
+	// without the client, so that the reply is not held back as an echo
+	out.Origin = mqtt.Origin{Transport: msg.Origin.Transport, Hops: msg.Origin.Hops + 1}
+	mqttServer.Publish(nil, out.WithContext(msg.Context()))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/j-forster/Waziup-API/mqtt"
+	routing "github.com/julienschmidt/httprouter"
+)
+
+// POST /mqtt/publish/<topic>?qos=1&retain=true publishes the request body
+// at the topic. The request is an in-process MQTT client with the HTTP Basic
+// credentials, so the ACL and the limits apply like for MQTT clients.
+func PostPublish(resp http.ResponseWriter, req *http.Request, params routing.Params) {
+
+	if _, ok := mqttUser(req); ok {
+		http.Error(resp, "Method Not Allowed: Publish to the topic instead.", http.StatusMethodNotAllowed)
+		return
+	}
+	topic := strings.TrimPrefix(params.ByName("topic"), "/")
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		http.Error(resp, "Bad Request: Invalid topic.", http.StatusBadRequest)
+		return
+	}
+	query := req.URL.Query()
+	var qos byte
+	if s := query.Get("qos"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > 2 {
+			http.Error(resp, "Bad Request: qos must be 0, 1 or 2.", http.StatusBadRequest)
+			return
+		}
+		qos = byte(n)
+	}
+	var retain bool
+	if s := query.Get("retain"); s != "" {
+		var err error
+		if retain, err = strconv.ParseBool(s); err != nil {
+			http.Error(resp, "Bad Request: retain must be true or false.", http.StatusBadRequest)
+			return
+		}
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(resp, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, password, _ := req.BasicAuth()
+	client, err := mqttServer.NewClient(newClientID("http"), name, password)
+	if err != nil {
+		mqttError(resp, req, err)
+		return
+	}
+	defer client.Close()
+
+	msg := mqtt.NewMessage(topic, body, qos, retain)
+	msg.ContentType = req.Header.Get("Content-Type")
+	msg.Origin = requestOrigin(req).Hop()
+	if err := client.Publish(msg.WithContext(req.Context())); err != nil {
+		mqttError(resp, req, err)
+		return
+	}
+	resp.Write([]byte("Published."))
+}
+
+////////////////////
+
+// RESTEvent publishes a MQTT message when a REST request of the route
+// succeeded (2xx). The message is a JSON object (see restEventPayload)
+// that describes the request.
+type RESTEvent struct {
+	// e.g. "POST", all methods if empty
+	Method string `json:"method"`
+	// the route pattern, like in the metrics: e.g. "/devices/:device_id"
+	Route string `json:"route"`
+	// ":name" segments are replaced by the parameters of the route,
+	// defaults to the path of the request (without the leading "/")
+	Topic  string `json:"topic"`
+	QoS    byte   `json:"qos"`
+	Retain bool   `json:"retain"`
+}
+
+type restEventPayload struct {
+	Method      string            `json:"method"`
+	Path        string            `json:"path"`
+	Route       string            `json:"route"`
+	Params      map[string]string `json:"params,omitempty"`
+	Status      int               `json:"status"`
+	User        string            `json:"user,omitempty"`
+	Time        string            `json:"time"`
+	ContentType string            `json:"content_type,omitempty"`
+	// the request body if it is JSON, body_base64 otherwise
+	Body       json.RawMessage `json:"body,omitempty"`
+	BodyBase64 []byte          `json:"body_base64,omitempty"`
+}
+
+func validateRESTEvents(events []*RESTEvent) error {
+
+	for _, evt := range events {
+		if evt.Route == "" {
+			return fmt.Errorf("rest event without route")
+		}
+		if evt.Method == "PUBLISH" {
+			// MQTT messages that reach the REST API would be published again
+			return fmt.Errorf("rest event %q: method PUBLISH not allowed", evt.Route)
+		}
+		if evt.QoS > 2 {
+			return fmt.Errorf("rest event %q: qos must be 0..2", evt.Route)
+		}
+		if strings.ContainsAny(evt.Topic, "+#") {
+			return fmt.Errorf("rest event %q: topic must not contain wildcards", evt.Route)
+		}
+	}
+	return nil
+}
+
+// publishRESTEvents publishes the events of a request that succeeded,
+// body is the request body (PUT and POST only).
+func publishRESTEvents(req *http.Request, route string, status int, body []byte) {
+
+	if req.Method == "PUBLISH" || status/100 != 2 {
+		return
+	}
+	var payload []byte
+	var params routing.Params
+	origin := requestOrigin(req).Hop()
+	for _, evt := range currentConfig().RESTEvents {
+		if evt.Route != route || (evt.Method != "" && evt.Method != req.Method) {
+			continue
+		}
+		if payload == nil {
+			_, params, _ = router.Lookup(req.Method, req.URL.Path)
+			payload = restEvent(req, route, params, status, body)
+		}
+		topic := strings.TrimPrefix(req.URL.Path, "/")
+		if evt.Topic != "" {
+			topic = expandTopic(evt.Topic, params)
+		}
+		msg := mqtt.NewMessage(topic, payload, evt.QoS, evt.Retain)
+		msg.ContentType = "application/json"
+		msg.Origin = origin
+		mqttServer.Publish(nil, msg.WithContext(req.Context()))
+	}
+}
+
+func restEvent(req *http.Request, route string, params routing.Params, status int, body []byte) []byte {
+
+	user, _, _ := req.BasicAuth()
+	if device := req.Header.Get("X-Device-Id"); device != "" {
+		user = devicePrincipal(device)
+	} else if name, ok := mqttUser(req); ok {
+		user = name
+	}
+	evt := restEventPayload{
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		Route:       route,
+		Status:      status,
+		User:        user,
+		Time:        time.Now().UTC().Format(time.RFC3339Nano),
+		ContentType: req.Header.Get("Content-Type"),
+	}
+	if len(params) != 0 {
+		evt.Params = make(map[string]string, len(params))
+		for _, param := range params {
+			evt.Params[param.Key] = strings.TrimPrefix(param.Value, "/")
+		}
+	}
+	if json.Valid(body) {
+		evt.Body = body
+	} else {
+		evt.BodyBase64 = body
+	}
+	data, _ := json.Marshal(&evt)
+	return data
+}
+
+// expandTopic replaces the ":name" segments of the topic with the parameters.
+func expandTopic(topic string, params routing.Params) string {
+
+	segments := strings.Split(topic, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = strings.TrimPrefix(params.ByName(segment[1:]), "/")
+		}
+	}
+	return strings.Join(segments, "/")
+}
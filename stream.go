@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/j-forster/Waziup-API/metrics"
+	"github.com/j-forster/Waziup-API/mqtt"
+	routing "github.com/julienschmidt/httprouter"
+)
+
+// GET /stream?topic=<filter>&topic=... streams the messages of the topic
+// filters as Server-Sent Events, for web clients that can not use MQTT over
+// WebSocket. Every stream is an in-process MQTT client with the HTTP Basic
+// credentials of the request, so the ACL applies like for MQTT clients.
+//
+// The event id is the time the server received the message (in nanoseconds
+// since 1970). A client that reconnects with Last-Event-ID gets the messages
+// it missed, as long as they are still in the replay buffer.
+
+const (
+	// the replay buffer keeps at most streamReplaySize messages,
+	// for at most streamReplayAge
+	streamReplaySize = 1000
+	streamReplayAge  = 5 * time.Minute
+	// comment lines keep idle streams open through proxies
+	streamKeepAlive = 20 * time.Second
+)
+
+var streamsOpen = metrics.NewGaugeVec("http_streams",
+	"Number of open Server-Sent Events streams.")
+
+func init() {
+	metrics.Register(streamsOpen)
+}
+
+// streamEvent is the data of an event.
+type streamEvent struct {
+	Topic string `json:"topic"`
+	// the payload if it is JSON, payload_base64 otherwise
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	PayloadBase64 []byte          `json:"payload_base64,omitempty"`
+	ContentType   string          `json:"content_type,omitempty"`
+	Retain        bool            `json:"retain,omitempty"`
+	Time          string          `json:"time,omitempty"`
+}
+
+func eventID(msg *mqtt.Message) int64 {
+
+	if msg.Received().IsZero() {
+		return 0
+	}
+	return msg.Received().UnixNano()
+}
+
+func writeEvent(w io.Writer, msg *mqtt.Message) error {
+
+	evt := streamEvent{
+		Topic:       msg.Topic,
+		ContentType: msg.ContentType,
+		Retain:      msg.Retain(),
+	}
+	if json.Valid(msg.Buf) {
+		evt.Payload = msg.Buf
+	} else {
+		evt.PayloadBase64 = msg.Buf
+	}
+	if !msg.Received().IsZero() {
+		evt.Time = msg.Received().UTC().Format(time.RFC3339Nano)
+	}
+	data, err := json.Marshal(&evt)
+	if err != nil {
+		return err
+	}
+	if id := eventID(msg); id != 0 {
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", id, data)
+	} else {
+		_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	return err
+}
+
+////////////////////
+
+// replayBuffer keeps the recent messages of all topics.
+type replayBuffer struct {
+	mutex sync.Mutex
+	msgs  []*mqtt.Message
+}
+
+var replay replayBuffer
+
+// startReplay subscribes the replay buffer, when the MQTT server is started.
+func startReplay() {
+
+	mqttServer.SubscribeFunc("#", 0, replay.add)
+}
+
+// add is called from the server loop.
+func (r *replayBuffer) add(msg *mqtt.Message) {
+
+	if msg.Received().IsZero() {
+		// a retained message from the storage
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.msgs = append(r.msgs, msg)
+	expired := time.Now().Add(-streamReplayAge)
+	n := 0
+	for n < len(r.msgs) && (len(r.msgs)-n > streamReplaySize || r.msgs[n].Received().Before(expired)) {
+		r.msgs[n] = nil
+		n++
+	}
+	r.msgs = r.msgs[n:]
+}
+
+// since returns the messages after the event id.
+func (r *replayBuffer) since(id int64) []*mqtt.Message {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var msgs []*mqtt.Message
+	for _, msg := range r.msgs {
+		if eventID(msg) > id {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+////////////////////
+
+func GetStream(resp http.ResponseWriter, req *http.Request, params routing.Params) {
+
+	filters := req.URL.Query()["topic"]
+	if len(filters) == 0 {
+		http.Error(resp, "Bad Request: Missing topic.", http.StatusBadRequest)
+		return
+	}
+	var lastID int64
+	if s := req.Header.Get("Last-Event-ID"); s != "" {
+		var err error
+		if lastID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(resp, "Bad Request: Invalid Last-Event-ID.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	name, password, _ := req.BasicAuth()
+	client, err := mqttServer.NewClient(newClientID("stream"), name, password)
+	if err != nil {
+		mqttError(resp, req, err)
+		return
+	}
+	defer client.Close()
+	// subscribed before the replay, so that no message is missed
+	for _, filter := range filters {
+		if err := client.Subscribe(filter, 0, nil); err != nil {
+			mqttError(resp, req, err)
+			return
+		}
+	}
+
+	streamsOpen.With().Inc()
+	defer streamsOpen.With().Dec()
+
+	header := resp.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	resp.WriteHeader(http.StatusOK)
+
+	ctrl := http.NewResponseController(resp)
+	// the write timeout of the server would end the stream
+	ctrl.SetWriteDeadline(time.Time{})
+
+	// ids of replayed messages that arrive from the subscriptions too
+	replayed := make(map[int64]bool)
+	if lastID != 0 {
+		user := connUser(client.Connection())
+		cfg := currentConfig()
+		for _, msg := range replay.since(lastID) {
+			if !matchAny(filters, msg.Topic) || !cfg.Allowed(user, msg.Topic, READ) {
+				continue
+			}
+			if err := writeEvent(resp, msg); err != nil {
+				return
+			}
+			replayed[eventID(msg)] = true
+		}
+	}
+	if err := ctrl.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case msg, ok := <-client.Messages():
+			if !ok {
+				// closed by the server
+				return
+			}
+			if id := eventID(msg); replayed[id] {
+				delete(replayed, id)
+				continue
+			}
+			err = writeEvent(resp, msg)
+		case <-keepAlive.C:
+			_, err = io.WriteString(resp, ": keep-alive\n\n")
+		case <-req.Context().Done():
+			return
+		}
+		if err == nil {
+			err = ctrl.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func matchAny(filters []string, topic string) bool {
+
+	for _, filter := range filters {
+		if mqtt.Match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,8 +2,10 @@ package tools
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
 	"io/ioutil"
+	"net/http"
 )
 
 type ClosingBuffer struct {
@@ -23,3 +25,15 @@ func ReadAll(rc io.ReadCloser) ([]byte, error) {
 
 	return ioutil.ReadAll(rc)
 }
+
+// WriteJSON writes v as the JSON response.
+func WriteJSON(resp http.ResponseWriter, v interface{}) {
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(resp, "Internal Server Error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(data)
+}